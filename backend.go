@@ -7,6 +7,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/Sirupsen/logrus"
 )
 
 var (
@@ -15,10 +17,11 @@ var (
 
 type Client struct {
 	DataDir string
+	Backups int
 }
 
-func NewBackend(datadir string) *Client {
-	return &Client{datadir}
+func NewBackend(datadir string, backups int) *Client {
+	return &Client{datadir, backups}
 }
 
 func transform(key string) string {
@@ -26,8 +29,40 @@ func transform(key string) string {
 	return strings.ToLower(replacer.Replace(k))
 }
 
+func (c *Client) filename(key string) string {
+	return filepath.Join(c.DataDir, fmt.Sprintf("%s.json", transform(key)))
+}
+
+func backupFilename(filename string, n int) string {
+	return fmt.Sprintf("%s.%d", filename, n)
+}
+
 func (c *Client) Load(key string, vars interface{}) error {
-	filename := filepath.Join(c.DataDir, fmt.Sprintf("%s.json", transform(key)))
+	filename := c.filename(key)
+	candidates := []string{filename}
+	for i := 1; i <= c.Backups; i++ {
+		candidates = append(candidates, backupFilename(filename, i))
+	}
+	var firstErr error
+	for _, candidate := range candidates {
+		err := loadFile(candidate, vars)
+		if err == nil {
+			if candidate != filename {
+				logrus.Warnf("Loaded '%s' from snapshot '%s'", key, candidate)
+			}
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if !os.IsNotExist(err) {
+			logrus.Errorf("Could not load snapshot '%s': %v", candidate, err)
+		}
+	}
+	return firstErr
+}
+
+func loadFile(filename string, vars interface{}) error {
 	if _, err := os.Stat(filename); err != nil {
 		return err
 	}
@@ -43,19 +78,74 @@ func (c *Client) Load(key string, vars interface{}) error {
 }
 
 func (c *Client) Save(key string, vars interface{}) error {
-	filename := filepath.Join(c.DataDir, fmt.Sprintf("%s.json", transform(key)))
-	keyFile, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
-	if err != nil {
-		return fmt.Errorf("Could not open file: %v", err)
-	}
-	defer keyFile.Close()
+	filename := c.filename(key)
 	json, err := json.Marshal(vars)
 	if err != nil {
 		return err
 	}
-	_, err = keyFile.WriteString(string(json))
+	tmpFile, err := ioutil.TempFile(c.DataDir, fmt.Sprintf(".%s.tmp", filepath.Base(filename)))
 	if err != nil {
+		return fmt.Errorf("Could not create temporary file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(json); err != nil {
+		tmpFile.Close()
 		return fmt.Errorf("Could not write to file: %s", err)
 	}
-	return nil
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("Could not sync file: %v", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("Could not close file: %v", err)
+	}
+	if err := os.Chmod(tmpFile.Name(), fileMode(filename)); err != nil {
+		return err
+	}
+	if err := c.rotate(filename); err != nil {
+		return fmt.Errorf("Could not rotate snapshots: %v", err)
+	}
+	if err := os.Rename(tmpFile.Name(), filename); err != nil {
+		return fmt.Errorf("Could not replace file: %v", err)
+	}
+	return syncDir(c.DataDir)
+}
+
+// fileMode returns the mode of the file being replaced without write access
+// for group and others. New files are private, webhooks.json holds secrets.
+func fileMode(filename string) os.FileMode {
+	st, err := os.Stat(filename)
+	if err != nil {
+		return 0600
+	}
+	return st.Mode().Perm() &^ 0022
+}
+
+func (c *Client) rotate(filename string) error {
+	if c.Backups <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return nil
+	}
+	for i := c.Backups - 1; i >= 1; i-- {
+		err := os.Rename(backupFilename(filename, i), backupFilename(filename, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	first := backupFilename(filename, 1)
+	if err := os.Remove(first); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Link(filename, first)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClientSaveMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing os.FileMode
+		want     os.FileMode
+	}{
+		{"new file", 0, 0600},
+		{"private", 0600, 0600},
+		{"readable", 0644, 0644},
+		{"group writable", 0660, 0640},
+		{"world writable", 0666, 0644},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewBackend(t.TempDir(), 1)
+			filename := filepath.Join(c.DataDir, "webhooks.json")
+			if tt.existing != 0 {
+				if err := c.Save("webhooks", map[string]string{}); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chmod(filename, tt.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.Save("webhooks", map[string]string{"a": "secret"}); err != nil {
+				t.Fatal(err)
+			}
+			st, err := os.Stat(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode := st.Mode().Perm(); mode != tt.want {
+				t.Errorf("mode = %o, want %o", mode, tt.want)
+			}
+		})
+	}
+}
@@ -1,17 +1,20 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"flag"
-	"os"
-	"strconv"
+	"fmt"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/paradev-ru/peskar-hub/lib"
+	"github.com/paradev-ru/peskar-hub/peskar"
 )
 
 const (
 	DefaultDataDir          = "/opt/peskar/data"
+	DefaultDataBackups      = 5
 	DefaultListenAddr       = "0.0.0.0:8080"
 	DefaultParallelJobCount = 1
 	DefaultRedisAddr        = "redis://localhost:6379/0"
@@ -19,10 +22,35 @@ const (
 	DefaultRedisMaxIdle     = 3
 	DefaultDndStartsAt      = 7
 	DefaultDndEndsAt        = 18
+	DefaultStore            = StoreFile
+	DefaultRetryMaxAttempts = 1
+	DefaultRetryBackoff     = peskar.BackoffExponential
+	DefaultRetryDelay       = time.Minute
+	DefaultRetryMaxDelay    = time.Hour
+	DefaultRetryJitter      = 0.2
+	DefaultRequestTimeout   = 5 * time.Minute
+	DefaultLeaseDuration    = 5 * time.Minute
+	DefaultWorkerTimeout    = 5 * time.Minute
+	DefaultWebhookAttempts  = 5
+	DefaultWebhookDelay     = 10 * time.Second
+	DefaultWebhookMaxDelay  = 10 * time.Minute
+	DefaultWebhookTimeout   = 10 * time.Second
+	DefaultRedisStreamLen   = 10000
+	DefaultRedisRetryDelay  = time.Second
+	DefaultRedisMaxDelay    = time.Minute
+	DefaultRedisRetryJitter = 0.2
+	DefaultShutdownTimeout  = 30 * time.Second
+
+	StoreFile  = "file"
+	StoreRedis = "redis"
+
+	RedisStreamGroup = "peskar-hub"
 )
 
 var (
 	datadir          string
+	dataBackups      int
+	store            string
 	listenAddr       string
 	logLevel         string
 	parallelJobCount int
@@ -34,38 +62,154 @@ var (
 	dndEnable        bool
 	dndStartsAt      int
 	dndEndsAt        int
+	dndSchedule      string
+	dndTimeZone      string
+	retryMaxAttempts int
+	retryBackoff     string
+	retryDelay       time.Duration
+	retryMaxDelay    time.Duration
+	retryJitter      float64
+	requestTimeout   time.Duration
+	leaseDuration    time.Duration
+	workerTimeout    time.Duration
+	webhookAttempts  int
+	webhookDelay     time.Duration
+	webhookMaxDelay  time.Duration
+	webhookTimeout   time.Duration
+	redisStreams     bool
+	redisStreamLen   int
+	redisDelay       time.Duration
+	redisMaxDelay    time.Duration
+	redisJitter      float64
+	redisGiveUpAfter time.Duration
+	redisUsername    string
+	redisPassword    string
+	redisTLSCA       string
+	redisTLSCert     string
+	redisTLSKey      string
+	redisTLSSkip     bool
+	sentinelAddrs    string
+	sentinelMaster   string
+	sentinelPassword string
+	shutdownTimeout  time.Duration
+	configFile       string
+	printConfig      bool
 )
 
 type Config struct {
-	ParallelJobCount int
-	ListenAddr       string
-	LogLevel         string
-	DataDir          string
-	RedisAddr        string
-	RedisIdleTimeout time.Duration
-	RedisMaxIdle     int
-	DndEnable        bool
-	DndStartsAt      int
-	DndEndsAt        int
+	ParallelJobCount int           `toml:"parallel-jobs" env:"PESKAR_PARALLEL_JOBS"`
+	ListenAddr       string        `toml:"listen-addr" env:"PESKAR_LISTEN_ADDR"`
+	LogLevel         string        `toml:"log-level" env:"PESKAR_LOG_LEVEL"`
+	DataDir          string        `toml:"datadir" env:"PESKAR_DATADIR"`
+	DataBackups      int           `toml:"data-backups" env:"PESKAR_DATA_BACKUPS"`
+	Store            string        `toml:"store" env:"PESKAR_STORE"`
+	RedisAddr        string        `toml:"redis-addr" env:"PESKAR_REDIS_ADDR"`
+	RedisIdleTimeout time.Duration `toml:"redis-idle-timeout" env:"PESKAR_REDIS_IDLE_TIMEOUT"`
+	RedisMaxIdle     int           `toml:"redis-max-idle" env:"PESKAR_REDIS_MAX_IDLE"`
+	DndEnable        bool          `toml:"dnd-enable" env:"PESKAR_DND_MODE"`
+	DndStartsAt      int           `toml:"dnd-start" env:"PESKAR_DND_START"`
+	DndEndsAt        int           `toml:"dnd-end" env:"PESKAR_DND_END"`
+	DndSchedule      string        `toml:"dnd-schedule" env:"PESKAR_DND_SCHEDULE"`
+	DndTimeZone      string        `toml:"dnd-time-zone" env:"PESKAR_DND_TIME_ZONE"`
+	RetryMaxAttempts int           `toml:"retry-max-attempts" env:"PESKAR_RETRY_MAX_ATTEMPTS"`
+	RetryBackoff     string        `toml:"retry-backoff" env:"PESKAR_RETRY_BACKOFF"`
+	RetryDelay       time.Duration `toml:"retry-delay" env:"PESKAR_RETRY_DELAY"`
+	RetryMaxDelay    time.Duration `toml:"retry-max-delay" env:"PESKAR_RETRY_MAX_DELAY"`
+	RetryJitter      float64       `toml:"retry-jitter" env:"PESKAR_RETRY_JITTER"`
+	RequestTimeout   time.Duration `toml:"request-timeout" env:"PESKAR_REQUEST_TIMEOUT"`
+	LeaseDuration    time.Duration `toml:"lease-duration" env:"PESKAR_LEASE_DURATION"`
+	WorkerTimeout    time.Duration `toml:"worker-timeout" env:"PESKAR_WORKER_TIMEOUT"`
+	WebhookAttempts  int           `toml:"webhook-max-attempts" env:"PESKAR_WEBHOOK_MAX_ATTEMPTS"`
+	WebhookDelay     time.Duration `toml:"webhook-delay" env:"PESKAR_WEBHOOK_DELAY"`
+	WebhookMaxDelay  time.Duration `toml:"webhook-max-delay" env:"PESKAR_WEBHOOK_MAX_DELAY"`
+	WebhookTimeout   time.Duration `toml:"webhook-timeout" env:"PESKAR_WEBHOOK_TIMEOUT"`
+	RedisStreams     bool          `toml:"redis-streams" env:"PESKAR_REDIS_STREAMS"`
+	RedisStreamLen   int           `toml:"redis-stream-max-len" env:"PESKAR_REDIS_STREAM_MAX_LEN"`
+	RedisRetryDelay  time.Duration `toml:"redis-retry-delay" env:"PESKAR_REDIS_RETRY_DELAY"`
+	RedisMaxDelay    time.Duration `toml:"redis-retry-max-delay" env:"PESKAR_REDIS_RETRY_MAX_DELAY"`
+	RedisRetryJitter float64       `toml:"redis-retry-jitter" env:"PESKAR_REDIS_RETRY_JITTER"`
+	RedisGiveUpAfter time.Duration `toml:"redis-retry-timeout" env:"PESKAR_REDIS_RETRY_TIMEOUT"`
+	ShutdownTimeout  time.Duration `toml:"shutdown-timeout" env:"PESKAR_SHUTDOWN_TIMEOUT"`
+
+	RedisUsername         string   `toml:"redis-username" env:"PESKAR_REDIS_USERNAME"`
+	RedisPassword         string   `toml:"redis-password" env:"PESKAR_REDIS_PASSWORD"`
+	RedisTLSCA            string   `toml:"redis-tls-ca" env:"PESKAR_REDIS_TLS_CA"`
+	RedisTLSCert          string   `toml:"redis-tls-cert" env:"PESKAR_REDIS_TLS_CERT"`
+	RedisTLSKey           string   `toml:"redis-tls-key" env:"PESKAR_REDIS_TLS_KEY"`
+	RedisTLSSkipVerify    bool     `toml:"redis-tls-skip-verify" env:"PESKAR_REDIS_TLS_SKIP_VERIFY"`
+	RedisSentinels        []string `toml:"redis-sentinels" env:"PESKAR_REDIS_SENTINELS"`
+	RedisSentinelMaster   string   `toml:"redis-sentinel-master" env:"PESKAR_REDIS_SENTINEL_MASTER"`
+	RedisSentinelPassword string   `toml:"redis-sentinel-password" env:"PESKAR_REDIS_SENTINEL_PASSWORD"`
+
+	schedule *lib.Schedule
+	redisTLS *tls.Config
 }
 
 func init() {
 	flag.StringVar(&datadir, "datadir", "", "data directory")
+	flag.IntVar(&dataBackups, "data-backups", 0, "number of previous snapshots to keep in data directory")
 	flag.IntVar(&parallelJobCount, "parallel-jobs", 0, "number of parallel jobs")
+	flag.StringVar(&store, "store", "", "where jobs and workers are kept: file or redis")
 	flag.StringVar(&listenAddr, "listen-addr", "", "listen address")
 	flag.StringVar(&logLevel, "log-level", "", "level which hub should log messages")
 	flag.BoolVar(&printVersion, "version", false, "print version and exit")
+	flag.StringVar(&configFile, "config", "", "TOML config file, its settings are overridden by env vars and flags")
+	flag.BoolVar(&printConfig, "print-config", false, "print the effective config and exit")
 	flag.StringVar(&redisAddr, "redis-addr", "", "Redis server URL")
 	flag.DurationVar(&redisIdleTimeout, "redis-idle-timeout", 0*time.Second, "close Redis connections after remaining idle for this duration")
 	flag.IntVar(&redisMaxIdle, "redis-max-idle", 0, "Maximum number of idle connections in the Redis pool")
 	flag.BoolVar(&dndEnable, "dnd-enable", false, "enable dnd mode")
 	flag.IntVar(&dndStartsAt, "dnd-start", 0, "dnd mode start hour")
 	flag.IntVar(&dndEndsAt, "dnd-end", 0, "dnd mode end hour")
+	flag.StringVar(&dndSchedule, "dnd-schedule", "", "JSON file with dnd schedule, overrides -dnd-start and -dnd-end")
+	flag.StringVar(&dndTimeZone, "dnd-time-zone", "", "IANA time zone of -dnd-start and -dnd-end, local by default")
+	flag.IntVar(&retryMaxAttempts, "retry-max-attempts", 0, "default number of attempts for a failed job")
+	flag.StringVar(&retryBackoff, "retry-backoff", "", "default delay growth between attempts: fixed or exponential")
+	flag.DurationVar(&retryDelay, "retry-delay", 0*time.Second, "delay before the second attempt")
+	flag.DurationVar(&retryMaxDelay, "retry-max-delay", 0*time.Second, "maximum delay between attempts")
+	flag.Float64Var(&retryJitter, "retry-jitter", 0, "random fraction of the delay added to it")
+	flag.DurationVar(&requestTimeout, "request-timeout", 0*time.Second, "time a worker has to start a requested job")
+	flag.DurationVar(&leaseDuration, "lease-duration", 0*time.Second, "time a working job lease lasts without renewal (default 5m), 0 disables expiration")
+	flag.DurationVar(&workerTimeout, "worker-timeout", 0*time.Second, "mark a worker inactive after not seeing it for this duration")
+	flag.IntVar(&webhookAttempts, "webhook-max-attempts", 0, "number of attempts to deliver a webhook")
+	flag.DurationVar(&webhookDelay, "webhook-delay", 0*time.Second, "delay before the second webhook delivery attempt, doubled for each next one")
+	flag.DurationVar(&webhookMaxDelay, "webhook-max-delay", 0*time.Second, "maximum delay between webhook delivery attempts")
+	flag.DurationVar(&webhookTimeout, "webhook-timeout", 0*time.Second, "timeout of a webhook request")
+	flag.BoolVar(&redisStreams, "redis-streams", false, "use Redis Streams instead of Pub/Sub for job events and logs")
+	flag.IntVar(&redisStreamLen, "redis-stream-max-len", 0, "approximate maximum number of entries kept in a Redis stream")
+	flag.DurationVar(&redisDelay, "redis-retry-delay", 0*time.Second, "delay before the second Redis reconnect attempt, doubled for each next one")
+	flag.DurationVar(&redisMaxDelay, "redis-retry-max-delay", 0*time.Second, "maximum delay between Redis reconnect attempts")
+	flag.Float64Var(&redisJitter, "redis-retry-jitter", 0, "random fraction of the Redis reconnect delay added to it")
+	flag.DurationVar(&redisGiveUpAfter, "redis-retry-timeout", 0*time.Second, "restart a Redis subscriber after failing to reconnect for this duration, 0 retries forever")
+	flag.StringVar(&redisUsername, "redis-username", "", "Redis ACL user name")
+	flag.StringVar(&redisPassword, "redis-password", "", "Redis password, overrides the one from -redis-addr")
+	flag.StringVar(&redisTLSCA, "redis-tls-ca", "", "CA certificate file to verify Redis server with a rediss:// URL")
+	flag.StringVar(&redisTLSCert, "redis-tls-cert", "", "client certificate file for Redis TLS")
+	flag.StringVar(&redisTLSKey, "redis-tls-key", "", "client key file for Redis TLS")
+	flag.BoolVar(&redisTLSSkip, "redis-tls-skip-verify", false, "do not verify Redis server certificate")
+	flag.StringVar(&sentinelAddrs, "redis-sentinels", "", "comma separated Redis Sentinel addresses, the master is discovered through them")
+	flag.StringVar(&sentinelMaster, "redis-sentinel-master", "", "name of the master monitored by Redis Sentinel")
+	flag.StringVar(&sentinelPassword, "redis-sentinel-password", "", "Redis Sentinel password")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 0*time.Second, "time to wait for HTTP requests to finish on shutdown")
 }
 
 func initConfig() error {
-	config = Config{
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	config = *c
+	setLogLevel(config.LogLevel)
+	return nil
+}
+
+// loadConfig reads the settings with precedence defaults < config file <
+// env < flags.
+func loadConfig() (*Config, error) {
+	c := &Config{
 		DataDir:          DefaultDataDir,
+		DataBackups:      DefaultDataBackups,
+		Store:            DefaultStore,
 		ListenAddr:       DefaultListenAddr,
 		ParallelJobCount: DefaultParallelJobCount,
 		RedisAddr:        DefaultRedisAddr,
@@ -73,98 +217,338 @@ func initConfig() error {
 		RedisMaxIdle:     DefaultRedisMaxIdle,
 		DndStartsAt:      DefaultDndStartsAt,
 		DndEndsAt:        DefaultDndEndsAt,
+		RetryMaxAttempts: DefaultRetryMaxAttempts,
+		RetryBackoff:     DefaultRetryBackoff,
+		RetryDelay:       DefaultRetryDelay,
+		RetryMaxDelay:    DefaultRetryMaxDelay,
+		RetryJitter:      DefaultRetryJitter,
+		RequestTimeout:   DefaultRequestTimeout,
+		LeaseDuration:    DefaultLeaseDuration,
+		WorkerTimeout:    DefaultWorkerTimeout,
+		WebhookAttempts:  DefaultWebhookAttempts,
+		WebhookDelay:     DefaultWebhookDelay,
+		WebhookMaxDelay:  DefaultWebhookMaxDelay,
+		WebhookTimeout:   DefaultWebhookTimeout,
+		RedisStreamLen:   DefaultRedisStreamLen,
+		RedisRetryDelay:  DefaultRedisRetryDelay,
+		RedisMaxDelay:    DefaultRedisMaxDelay,
+		RedisRetryJitter: DefaultRedisRetryJitter,
+		ShutdownTimeout:  DefaultShutdownTimeout,
 	}
 
-	processEnv()
+	if err := c.LoadFile(configPath()); err != nil {
+		return nil, err
+	}
 
-	processFlags()
+	if err := c.processEnv(); err != nil {
+		return nil, err
+	}
 
-	if config.LogLevel != "" {
-		level, err := logrus.ParseLevel(config.LogLevel)
-		if err != nil {
+	c.processFlags()
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate checks the settings and loads the files they refer to.
+func (c *Config) Validate() error {
+	if c.LogLevel != "" {
+		if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
 			return err
 		}
-		logrus.SetLevel(level)
 	}
 
-	if config.RedisAddr == "" {
+	if c.RedisAddr == "" {
 		return errors.New("Must specify Redis server URL using -redis-addr")
 	}
 
-	if config.RedisIdleTimeout == 0*time.Second {
+	if c.RedisIdleTimeout == 0*time.Second {
 		return errors.New("Must specify Redis idle timeout using -redis-idle-timeout")
 	}
 
-	if config.RedisMaxIdle == 0 {
+	if c.RedisMaxIdle == 0 {
 		return errors.New("Must specify Redis max idle using -redis-max-idle")
 	}
 
-	if config.ParallelJobCount == 0 {
+	if err := c.LoadRedisTLS(); err != nil {
+		return err
+	}
+
+	if err := c.RedisOptions().Validate(); err != nil {
+		return err
+	}
+
+	if c.ParallelJobCount == 0 {
 		return errors.New("Must specify number of parallel jobs using -parallel-jobs")
 	}
 
-	if config.ListenAddr == "" {
+	if c.ListenAddr == "" {
 		return errors.New("Must specify HTTP listen address using -listen-addr")
 	}
 
-	if config.DataDir == "" {
+	if c.DataDir == "" {
 		return errors.New("Must specify data directory using -datadir")
 	}
 
-	return nil
-}
+	if c.Store != StoreFile && c.Store != StoreRedis {
+		return fmt.Errorf("Unknown store '%s', must be '%s' or '%s'", c.Store, StoreFile, StoreRedis)
+	}
+
+	// Every hub receives a Pub/Sub message and would store the log line
+	// again, a consumer group delivers a stream entry to one of them.
+	if c.Store == StoreRedis && !c.RedisStreams {
+		return fmt.Errorf("Store '%s' requires -redis-streams", StoreRedis)
+	}
+
+	if err := c.LoadSchedule(); err != nil {
+		return err
+	}
+
+	if err := c.RetryPolicy().Validate(); err != nil {
+		return err
+	}
+
+	if c.DataBackups < 0 {
+		return errors.New("Number of snapshots in -data-backups cant be negative")
+	}
+
+	if c.RequestTimeout <= 0 {
+		return errors.New("Must specify job request timeout using -request-timeout")
+	}
+
+	if c.LeaseDuration < 0 {
+		return errors.New("Lease duration in -lease-duration cant be negative")
+	}
+
+	if c.WorkerTimeout <= 0 {
+		return errors.New("Must specify worker timeout using -worker-timeout")
+	}
 
-func processEnv() {
-	redisAddrEnv := os.Getenv("PESKAR_REDIS_ADDR")
-	if len(redisAddrEnv) > 0 {
-		config.RedisAddr = redisAddrEnv
+	if err := c.WebhookRetryPolicy().Validate(); err != nil {
+		return err
 	}
-	listenAddrEnv := os.Getenv("PESKAR_LISTEN_ADDR")
-	if len(listenAddrEnv) > 0 {
-		config.ListenAddr = listenAddrEnv
+
+	if c.WebhookMaxDelay < c.WebhookDelay {
+		return errors.New("Webhook delay in -webhook-max-delay cant be less than -webhook-delay")
 	}
-	dataDirEnv := os.Getenv("PESKAR_DATADIR")
-	if len(dataDirEnv) > 0 {
-		config.DataDir = dataDirEnv
+
+	if c.WebhookTimeout <= 0 {
+		return errors.New("Must specify webhook timeout using -webhook-timeout")
 	}
-	if len(os.Getenv("PESKAR_DND_MODE")) > 0 {
-		config.DndEnable = true
+
+	if c.RedisStreamLen <= 0 {
+		return errors.New("Must specify Redis stream length using -redis-stream-max-len")
 	}
-	dndStartsAtEnv := os.Getenv("PESKAR_DND_START")
-	if i, err := strconv.Atoi(dndStartsAtEnv); err == nil {
-		config.DndStartsAt = i
+
+	if c.RedisRetryDelay <= 0 {
+		return errors.New("Must specify Redis reconnect delay using -redis-retry-delay")
 	}
-	dndEndsAtEnv := os.Getenv("PESKAR_DND_END")
-	if i, err := strconv.Atoi(dndEndsAtEnv); err == nil {
-		config.DndEndsAt = i
+
+	if c.RedisMaxDelay < c.RedisRetryDelay {
+		return errors.New("Redis reconnect delay in -redis-retry-max-delay cant be less than -redis-retry-delay")
 	}
+
+	if err := c.RedisRetryPolicy().Validate(); err != nil {
+		return err
+	}
+
+	if c.RedisGiveUpAfter < 0 {
+		return errors.New("Redis reconnect timeout in -redis-retry-timeout cant be negative")
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("Must specify shutdown timeout using -shutdown-timeout")
+	}
+
+	return nil
 }
 
-func processFlags() {
-	flag.Visit(setConfigFromFlag)
+func (c *Config) processFlags() {
+	flag.Visit(c.setFromFlag)
 }
 
-func setConfigFromFlag(f *flag.Flag) {
+func (c *Config) setFromFlag(f *flag.Flag) {
 	switch f.Name {
 	case "datadir":
-		config.DataDir = datadir
+		c.DataDir = datadir
+	case "store":
+		c.Store = store
+	case "data-backups":
+		c.DataBackups = dataBackups
 	case "parallel-jobs":
-		config.ParallelJobCount = parallelJobCount
+		c.ParallelJobCount = parallelJobCount
 	case "listen-addr":
-		config.ListenAddr = listenAddr
+		c.ListenAddr = listenAddr
 	case "redis-addr":
-		config.RedisAddr = redisAddr
+		c.RedisAddr = redisAddr
 	case "redis-idle-timeout":
-		config.RedisIdleTimeout = redisIdleTimeout
+		c.RedisIdleTimeout = redisIdleTimeout
 	case "redis-max-idle":
-		config.RedisMaxIdle = redisMaxIdle
+		c.RedisMaxIdle = redisMaxIdle
 	case "log-level":
-		config.LogLevel = logLevel
+		c.LogLevel = logLevel
 	case "dnd-enable":
-		config.DndEnable = dndEnable
+		c.DndEnable = dndEnable
 	case "dnd-start":
-		config.DndStartsAt = dndStartsAt
+		c.DndStartsAt = dndStartsAt
 	case "dnd-end":
-		config.DndEndsAt = dndEndsAt
+		c.DndEndsAt = dndEndsAt
+	case "dnd-schedule":
+		c.DndSchedule = dndSchedule
+	case "dnd-time-zone":
+		c.DndTimeZone = dndTimeZone
+	case "retry-max-attempts":
+		c.RetryMaxAttempts = retryMaxAttempts
+	case "retry-backoff":
+		c.RetryBackoff = retryBackoff
+	case "retry-delay":
+		c.RetryDelay = retryDelay
+	case "retry-max-delay":
+		c.RetryMaxDelay = retryMaxDelay
+	case "retry-jitter":
+		c.RetryJitter = retryJitter
+	case "request-timeout":
+		c.RequestTimeout = requestTimeout
+	case "lease-duration":
+		c.LeaseDuration = leaseDuration
+	case "worker-timeout":
+		c.WorkerTimeout = workerTimeout
+	case "webhook-max-attempts":
+		c.WebhookAttempts = webhookAttempts
+	case "webhook-delay":
+		c.WebhookDelay = webhookDelay
+	case "webhook-max-delay":
+		c.WebhookMaxDelay = webhookMaxDelay
+	case "webhook-timeout":
+		c.WebhookTimeout = webhookTimeout
+	case "redis-streams":
+		c.RedisStreams = redisStreams
+	case "redis-stream-max-len":
+		c.RedisStreamLen = redisStreamLen
+	case "redis-retry-delay":
+		c.RedisRetryDelay = redisDelay
+	case "redis-retry-max-delay":
+		c.RedisMaxDelay = redisMaxDelay
+	case "redis-retry-jitter":
+		c.RedisRetryJitter = redisJitter
+	case "redis-retry-timeout":
+		c.RedisGiveUpAfter = redisGiveUpAfter
+	case "redis-username":
+		c.RedisUsername = redisUsername
+	case "redis-password":
+		c.RedisPassword = redisPassword
+	case "redis-tls-ca":
+		c.RedisTLSCA = redisTLSCA
+	case "redis-tls-cert":
+		c.RedisTLSCert = redisTLSCert
+	case "redis-tls-key":
+		c.RedisTLSKey = redisTLSKey
+	case "redis-tls-skip-verify":
+		c.RedisTLSSkipVerify = redisTLSSkip
+	case "redis-sentinels":
+		c.RedisSentinels = getList(sentinelAddrs)
+	case "redis-sentinel-master":
+		c.RedisSentinelMaster = sentinelMaster
+	case "redis-sentinel-password":
+		c.RedisSentinelPassword = sentinelPassword
+	case "shutdown-timeout":
+		c.ShutdownTimeout = shutdownTimeout
+	}
+}
+
+// LoadSchedule reads the -dnd-schedule file or builds the schedule from
+// the hourly flags. A schedule file turns the dnd mode on.
+func (c *Config) LoadSchedule() error {
+	if c.DndSchedule != "" {
+		schedule, err := lib.LoadSchedule(c.DndSchedule)
+		if err != nil {
+			return err
+		}
+		c.DndEnable = true
+		c.schedule = schedule
+		return nil
+	}
+	if c.DndStartsAt < 0 || c.DndStartsAt > 23 || c.DndEndsAt < 0 || c.DndEndsAt > 23 {
+		return errors.New("Dnd hours in -dnd-start and -dnd-end must be between 0 and 23")
+	}
+	loc := time.Local
+	if c.DndTimeZone != "" {
+		var err error
+		loc, err = time.LoadLocation(c.DndTimeZone)
+		if err != nil {
+			return err
+		}
+	}
+	c.schedule = lib.NewHourlySchedule(c.DndStartsAt, c.DndEndsAt, loc)
+	return nil
+}
+
+func (c *Config) Schedule() *lib.Schedule {
+	if c.schedule == nil {
+		return lib.NewHourlySchedule(c.DndStartsAt, c.DndEndsAt, time.Local)
+	}
+	return c.schedule
+}
+
+func (c *Config) RetryPolicy() peskar.RetryPolicy {
+	return peskar.RetryPolicy{
+		MaxAttempts: c.RetryMaxAttempts,
+		Backoff:     c.RetryBackoff,
+		Delay:       c.RetryDelay,
+		MaxDelay:    c.RetryMaxDelay,
+		Jitter:      c.RetryJitter,
+	}
+}
+
+// LoadRedisTLS reads the certificates of the Redis TLS options, if any
+// of them is set.
+func (c *Config) LoadRedisTLS() error {
+	if c.RedisTLSCA == "" && c.RedisTLSCert == "" && c.RedisTLSKey == "" && !c.RedisTLSSkipVerify {
+		c.redisTLS = nil
+		return nil
+	}
+	tlsConfig, err := lib.LoadTLSConfig(c.RedisTLSCA, c.RedisTLSCert, c.RedisTLSKey, c.RedisTLSSkipVerify)
+	if err != nil {
+		return err
+	}
+	c.redisTLS = tlsConfig
+	return nil
+}
+
+func (c *Config) RedisOptions() lib.RedisOptions {
+	return lib.RedisOptions{
+		Addr:             c.RedisAddr,
+		MaxIdle:          c.RedisMaxIdle,
+		IdleTimeout:      c.RedisIdleTimeout,
+		Username:         c.RedisUsername,
+		Password:         c.RedisPassword,
+		TLSConfig:        c.redisTLS,
+		SentinelAddrs:    c.RedisSentinels,
+		SentinelMaster:   c.RedisSentinelMaster,
+		SentinelPassword: c.RedisSentinelPassword,
+	}
+}
+
+// RedisRetryPolicy is the delay between reconnects of a Redis subscriber,
+// attempts are limited by time with -redis-retry-timeout.
+func (c *Config) RedisRetryPolicy() peskar.RetryPolicy {
+	return peskar.RetryPolicy{
+		MaxAttempts: 1,
+		Backoff:     peskar.BackoffExponential,
+		Delay:       c.RedisRetryDelay,
+		MaxDelay:    c.RedisMaxDelay,
+		Jitter:      c.RedisRetryJitter,
+	}
+}
+
+func (c *Config) WebhookRetryPolicy() peskar.RetryPolicy {
+	return peskar.RetryPolicy{
+		MaxAttempts: c.WebhookAttempts,
+		Backoff:     peskar.BackoffExponential,
+		Delay:       c.WebhookDelay,
+		MaxDelay:    c.WebhookMaxDelay,
+		Jitter:      c.RetryJitter,
 	}
 }
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/Sirupsen/logrus"
+)
+
+const secretMask = "xxxxx"
+
+// reloadOptions can be changed by SIGHUP, the others need a restart.
+var reloadOptions = map[string]bool{
+	"log-level":     true,
+	"parallel-jobs": true,
+	"dnd-enable":    true,
+	"dnd-start":     true,
+	"dnd-end":       true,
+	"dnd-schedule":  true,
+	"dnd-time-zone": true,
+}
+
+// legacyBoolEnv enabled their option with any non-empty value before the
+// values were parsed, so unknown values still enable it.
+var legacyBoolEnv = map[string]bool{
+	"PESKAR_DND_MODE": true,
+}
+
+var secretOptions = map[string]bool{
+	"redis-password":          true,
+	"redis-sentinel-password": true,
+}
+
+func configPath() string {
+	if configFile != "" {
+		return configFile
+	}
+	return os.Getenv("PESKAR_CONFIG")
+}
+
+// LoadFile reads the TOML config file. Its keys are the flag names and
+// the values are given as for the flags or as TOML values, e.g.
+// redis-sentinels may be an array.
+func (c *Config) LoadFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	var raw map[string]interface{}
+	if _, err := toml.DecodeFile(path, &raw); err != nil {
+		return fmt.Errorf("Could not read config file '%s': %v", path, err)
+	}
+	var keys []string
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	options := c.options()
+	for _, key := range keys {
+		option, ok := options[key]
+		if !ok {
+			return fmt.Errorf("Unknown option '%s' in config file '%s'", key, path)
+		}
+		value, err := fileValue(raw[key])
+		if err == nil {
+			err = setOption(option, value)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid value of '%s' in config file '%s': %v", key, path, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) processEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		value := os.Getenv(name)
+		if len(value) == 0 {
+			continue
+		}
+		if err := setOption(v.Field(i), value); err != nil {
+			if legacyBoolEnv[name] {
+				logrus.Warnf("Unknown value '%s' of %s, treated as true", value, name)
+				v.Field(i).SetBool(true)
+				continue
+			}
+			return fmt.Errorf("Invalid value of %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// options maps the config file keys to the fields of c.
+func (c *Config) options() map[string]reflect.Value {
+	options := make(map[string]reflect.Value)
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if name := v.Type().Field(i).Tag.Get("toml"); name != "" {
+			options[name] = v.Field(i)
+		}
+	}
+	return options
+}
+
+func fileValue(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case []interface{}:
+		var items []string
+		for _, item := range value {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		return "", errors.New("Unexpected table")
+	}
+	return fmt.Sprint(value), nil
+}
+
+// setOption parses the value the same way for the config file and env.
+func setOption(field reflect.Value, value string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+	case int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(i))
+	case float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case bool:
+		b, err := parseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case []string:
+		field.Set(reflect.ValueOf(getList(value)))
+	}
+	return nil
+}
+
+// parseBool accepts the usual spellings of PESKAR_DND_MODE as well as
+// the ones of strconv.ParseBool.
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "t", "true", "y", "yes", "on":
+		return true, nil
+	case "0", "f", "false", "n", "no", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("Invalid boolean value '%s'", value)
+}
+
+// Print writes the settings in the config file format with the
+// passwords masked.
+func (c *Config) Print(w io.Writer) error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("toml")
+		if name == "" {
+			continue
+		}
+		value := v.Field(i).Interface()
+		switch {
+		case secretOptions[name] && value != "":
+			value = secretMask
+		case name == "redis-addr":
+			value = maskURL(c.RedisAddr)
+		}
+		if _, err := fmt.Fprintf(w, "%s = %s\n", name, tomlValue(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tomlValue(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return strconv.Quote(value)
+	case time.Duration:
+		return strconv.Quote(value.String())
+	case []string:
+		var items []string
+		for _, item := range value {
+			items = append(items, strconv.Quote(item))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+func maskURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.User == nil {
+		return rawurl
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), secretMask)
+	}
+	return u.String()
+}
+
+// changedOptions returns the config file keys of the settings that
+// differ between a and b.
+func changedOptions(a, b *Config) []string {
+	var changed []string
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		name := va.Type().Field(i).Tag.Get("toml")
+		if name == "" {
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+func setLogLevel(name string) {
+	level := logrus.InfoLevel
+	if name != "" {
+		level, _ = logrus.ParseLevel(name)
+	}
+	logrus.SetLevel(level)
+}
+
+// ReloadConfig reads the config file, env and flags again and applies
+// the log level, the dnd mode and the number of parallel jobs. Changes of
+// the other settings are logged and take effect after a restart.
+func (s *Server) ReloadConfig() error {
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	for _, name := range changedOptions(s.config, c) {
+		if reloadOptions[name] {
+			logrus.Infof("Option '%s' changed", name)
+		} else {
+			logrus.Warnf("Option '%s' changed, restart the hub to apply it", name)
+		}
+	}
+	s.config.LogLevel = c.LogLevel
+	s.config.ParallelJobCount = c.ParallelJobCount
+	s.config.DndEnable = c.DndEnable
+	s.config.DndStartsAt = c.DndStartsAt
+	s.config.DndEndsAt = c.DndEndsAt
+	s.config.DndSchedule = c.DndSchedule
+	s.config.DndTimeZone = c.DndTimeZone
+	s.config.schedule = c.schedule
+	setLogLevel(c.LogLevel)
+	return nil
+}
+
+// runtimeConfig returns the settings changed by ReloadConfig.
+func (s *Server) runtimeConfig() Config {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return *s.config
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSetOptionBool(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+		ok    bool
+	}{
+		{"1", true, true},
+		{"true", true, true},
+		{"TRUE", true, true},
+		{"yes", true, true},
+		{"On", true, true},
+		{"0", false, true},
+		{"false", false, true},
+		{"no", false, true},
+		{"OFF", false, true},
+		{" yes\n", true, true},
+		{"", false, false},
+		{"enabled", false, false},
+	}
+	for _, tt := range tests {
+		var c Config
+		c.DndEnable = !tt.want
+		err := setOption(reflect.ValueOf(&c).Elem().FieldByName("DndEnable"), tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: error = %v", tt.value, err)
+			continue
+		}
+		if tt.ok && c.DndEnable != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.value, c.DndEnable, tt.want)
+		}
+	}
+}
+
+func TestProcessEnvBool(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  bool
+		ok    bool
+	}{
+		{"PESKAR_DND_MODE", "1", true, true},
+		{"PESKAR_DND_MODE", " off ", false, true},
+		{"PESKAR_DND_MODE", "false", false, true},
+		{"PESKAR_DND_MODE", "enabled", true, true},
+		{"PESKAR_DND_MODE", " ", true, true},
+		{"PESKAR_REDIS_STREAMS", " Yes ", true, true},
+		{"PESKAR_REDIS_STREAMS", "0", false, true},
+		{"PESKAR_REDIS_STREAMS", "enabled", false, false},
+	}
+	for _, tt := range tests {
+		t.Setenv(tt.name, tt.value)
+		var c Config
+		c.DndEnable = !tt.want
+		c.RedisStreams = !tt.want
+		err := c.processEnv()
+		t.Setenv(tt.name, "")
+		if (err == nil) != tt.ok {
+			t.Errorf("%s=%q: error = %v", tt.name, tt.value, err)
+			continue
+		}
+		got := c.DndEnable
+		if tt.name == "PESKAR_REDIS_STREAMS" {
+			got = c.RedisStreams
+		}
+		if tt.ok && got != tt.want {
+			t.Errorf("%s=%q: got %v, want %v", tt.name, tt.value, got, tt.want)
+		}
+	}
+}
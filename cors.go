@@ -8,7 +8,7 @@ import (
 
 const (
 	methods = "POST, GET, OPTIONS, PUT, DELETE"
-	headers = "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization"
+	headers = "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Last-Event-ID"
 )
 
 type WithCORS struct {
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/paradev-ru/peskar-hub/peskar"
+)
+
+const (
+	EventJobCreated   = peskar.EventJobCreated
+	EventJobUpdated   = peskar.EventJobUpdated
+	EventJobDeleted   = peskar.EventJobDeleted
+	EventJobLog       = "job.log"
+	EventWorkerState  = "worker.state"
+	DefaultEventsSize = 1024
+	eventsChanSize    = 64
+)
+
+type Event struct {
+	ID            uint64       `json:"id"`
+	Type          string       `json:"type"`
+	JobID         string       `json:"job_id,omitempty"`
+	PreviousState peskar.State `json:"previous_state,omitempty"`
+	Data          interface{}  `json:"data"`
+	CreatedAt     time.Time    `json:"created_at"`
+}
+
+// Broker fans events out to stream subscribers and keeps the last ones
+// in a ring buffer so that reconnecting clients can resume.
+type Broker struct {
+	mu     sync.Mutex
+	lastID uint64
+	ring   []Event
+	next   int
+	subs   map[chan Event]struct{}
+}
+
+func NewBroker(size int) *Broker {
+	return &Broker{
+		ring: make([]Event, 0, size),
+		subs: make(map[chan Event]struct{}),
+	}
+}
+
+func (b *Broker) Publish(eventType, jobID string, data interface{}) {
+	b.publish(Event{
+		Type:  eventType,
+		JobID: jobID,
+		Data:  data,
+	})
+}
+
+func (b *Broker) PublishJob(eventType string, job peskar.Job, previous peskar.State) {
+	b.publish(Event{
+		Type:          eventType,
+		JobID:         job.ID,
+		PreviousState: previous,
+		Data:          job,
+	})
+}
+
+func (b *Broker) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastID++
+	e.ID = b.lastID
+	e.CreatedAt = time.Now().UTC()
+	if len(b.ring) < cap(b.ring) {
+		b.ring = append(b.ring, e)
+	} else if cap(b.ring) > 0 {
+		b.ring[b.next] = e
+		b.next = (b.next + 1) % cap(b.ring)
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			// Slow subscriber, it will resume from the ring after reconnect.
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns the buffered events published after lastID and a
+// channel with the following ones. An unknown lastID, e.g. from before
+// a restart, replays the whole buffer.
+func (b *Broker) Subscribe(lastID uint64) (<-chan Event, []Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if lastID > b.lastID {
+		lastID = 0
+	}
+	var backlog []Event
+	for i := range b.ring {
+		e := b.ring[(b.next+i)%len(b.ring)]
+		if e.ID > lastID {
+			backlog = append(backlog, e)
+		}
+	}
+	ch := make(chan Event, eventsChanSize)
+	b.subs[ch] = struct{}{}
+	return ch, backlog
+}
+
+func (b *Broker) Unsubscribe(ch <-chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		if sub == ch {
+			delete(b.subs, sub)
+			close(sub)
+			return
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/paradev-ru/peskar-hub/peskar"
+)
+
+func eventIDs(events []Event) string {
+	var ids []string
+	for _, e := range events {
+		ids = append(ids, fmt.Sprint(e.ID))
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestBrokerSubscribe(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		publish int
+		lastID  uint64
+		want    string
+	}{
+		{"everything", 8, 5, 0, "1,2,3,4,5"},
+		{"resume", 8, 5, 2, "3,4,5"},
+		{"up to date", 8, 5, 5, ""},
+		{"unknown id", 8, 5, 100, "1,2,3,4,5"},
+		{"wrapped ring", 3, 5, 0, "3,4,5"},
+		{"resume in wrapped ring", 3, 7, 5, "6,7"},
+	}
+	for _, tt := range tests {
+		b := NewBroker(tt.size)
+		for i := 0; i < tt.publish; i++ {
+			b.Publish(EventJobLog, "job", i)
+		}
+		ch, backlog := b.Subscribe(tt.lastID)
+		if got := eventIDs(backlog); got != tt.want {
+			t.Errorf("%s: backlog %s, want %s", tt.name, got, tt.want)
+		}
+		b.Publish(EventJobLog, "job", "next")
+		if e := <-ch; e.ID != uint64(tt.publish+1) {
+			t.Errorf("%s: got event %d after subscribing, want %d", tt.name, e.ID, tt.publish+1)
+		}
+		b.Unsubscribe(ch)
+	}
+}
+
+// TestBrokerSlowSubscriber checks that a subscriber whose buffer is full
+// is closed instead of blocking the publishers.
+func TestBrokerSlowSubscriber(t *testing.T) {
+	b := NewBroker(DefaultEventsSize)
+	slow, _ := b.Subscribe(0)
+	fast, _ := b.Subscribe(0)
+	for i := 0; i < eventsChanSize+1; i++ {
+		b.Publish(EventJobLog, "job", i)
+		<-fast
+	}
+	var received int
+	for range slow {
+		received++
+	}
+	if received != eventsChanSize {
+		t.Errorf("slow subscriber received %d events before closing, want %d", received, eventsChanSize)
+	}
+	b.Publish(EventJobLog, "job", "after")
+	if e, ok := <-fast; !ok || e.ID != eventsChanSize+2 {
+		t.Errorf("fast subscriber got %+v, %v", e, ok)
+	}
+	b.Unsubscribe(slow)
+	b.Unsubscribe(fast)
+}
+
+// streamEvents reads the events stream until the backlog is written.
+func streamEvents(t *testing.T, s *Server, url, lastEventID string) string {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("GET", url, nil).WithContext(ctx)
+	if lastEventID != "" {
+		r.Header.Set("Last-Event-ID", lastEventID)
+	}
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.r.ServeHTTP(w, r)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("content type %s", ct)
+	}
+	var events []string
+	for _, block := range strings.Split(w.Body.String(), "\n\n") {
+		var id, event string
+		for _, line := range strings.Split(block, "\n") {
+			if strings.HasPrefix(line, "id: ") {
+				id = strings.TrimPrefix(line, "id: ")
+			}
+			if strings.HasPrefix(line, "event: ") {
+				event = strings.TrimPrefix(line, "event: ")
+			}
+		}
+		if id != "" {
+			events = append(events, id+" "+event)
+		}
+	}
+	return strings.Join(events, ",")
+}
+
+func TestEventsHandler(t *testing.T) {
+	s := testServer(t, 1)
+	s.events.PublishJob(EventJobCreated, peskar.Job{ID: "a"}, "")
+	s.events.PublishJob(EventJobCreated, peskar.Job{ID: "b"}, "")
+	s.events.PublishJob(EventJobUpdated, peskar.Job{ID: "a", State: peskar.StateCanceled}, peskar.StatePending)
+	s.events.Publish(EventJobLog, "a", peskar.LogItem{JobID: "a", Message: "Line"})
+	s.events.Publish(EventWorkerState, "", peskar.Worker{ID: "worker"})
+
+	tests := []struct {
+		name        string
+		url         string
+		lastEventID string
+		want        string
+	}{
+		{"all", "/v1/events/", "", "1 job.created,2 job.created,3 job.updated,4 job.log,5 worker.state"},
+		{"job", "/v1/events/?job_id=a", "", "1 job.created,3 job.updated,4 job.log"},
+		{"types", "/v1/events/?type=job.created,worker.state", "", "1 job.created,2 job.created,5 worker.state"},
+		{"job and type", "/v1/events/?job_id=a&type=job.updated", "", "3 job.updated"},
+		{"resume", "/v1/events/", "3", "4 job.log,5 worker.state"},
+		{"resume by query", "/v1/events/?last_event_id=4", "", "5 worker.state"},
+	}
+	for _, tt := range tests {
+		if got := streamEvents(t, s, tt.url, tt.lastEventID); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestJobEventEnvelope(t *testing.T) {
+	m := miniredis.RunT(t)
+	s := redisTestServer(t, m, "hub-a")
+	ids := addTestJobs(t, s, 2)
+
+	job, err := s.Dispatch(peskar.Worker{ID: "worker-1"})
+	if err != nil || job == nil {
+		t.Fatal(job, err)
+	}
+	other := ids[0]
+	if other == job.ID {
+		other = ids[1]
+	}
+	if _, err := s.j.Update(job.ID, func(j *peskar.Job) error {
+		j.LeaseExpiresAt = time.Now().UTC().Add(-time.Minute)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RequeueZombieJobs(); err != nil {
+		t.Fatal(err)
+	}
+	if w := serveTest(s, "DELETE", "/v1/job/"+other+"/", "", nil, ""); w.Code != 200 {
+		t.Fatalf("delete returned %d: %s", w.Code, w.Body)
+	}
+
+	entries, err := m.Stream(peskar.JobEventsChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		eventType string
+		id        string
+		previous  peskar.State
+		state     peskar.State
+		initiator string
+		revision  int64
+	}{
+		{EventJobCreated, ids[0], "", peskar.StatePending, peskar.InitiatorUser, 1},
+		{EventJobCreated, ids[1], "", peskar.StatePending, peskar.InitiatorUser, 1},
+		{EventJobUpdated, job.ID, peskar.StatePending, peskar.StateRequested, peskar.InitiatorSystem, 2},
+		{EventJobUpdated, job.ID, peskar.StateRequested, peskar.StatePending, peskar.InitiatorSystem, 4},
+		{EventJobDeleted, other, peskar.StatePending, peskar.StateDeleted, peskar.InitiatorUser, 2},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d events, want %d", len(entries), len(want))
+	}
+	for i, tt := range want {
+		var e peskar.Event
+		if err := json.Unmarshal([]byte(entries[i].Values[1]), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Version != peskar.EventVersion || e.Type != tt.eventType || e.Job.ID != tt.id ||
+			e.PreviousState != tt.previous || e.Job.State != tt.state ||
+			e.Initiator != tt.initiator || e.Job.Revision != tt.revision || e.CreatedAt.IsZero() {
+			t.Errorf("event %d is %+v, want %+v", i, e, tt)
+		}
+	}
+}
+
+// TestJobEventRevisions checks that concurrent updates of a job get
+// distinct revisions, so their events can be put in store order.
+func TestJobEventRevisions(t *testing.T) {
+	s := testServer(t, 1)
+	id := addTestJobs(t, s, 1)[0]
+	ch, _ := s.events.Subscribe(0)
+	defer s.events.Unsubscribe(ch)
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(priority int) {
+			defer wg.Done()
+			if _, err := s.SetJobPriority(id, priority); err != nil {
+				t.Error(err)
+			}
+		}(i + 1)
+	}
+	wg.Wait()
+
+	priorities := make(map[int64]int)
+	for i := 0; i < n; i++ {
+		e := <-ch
+		job := e.Data.(peskar.Job)
+		priorities[job.Revision] = job.Priority
+	}
+	job, err := s.j.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(priorities) != n || job.Revision != n+1 {
+		t.Fatalf("got revisions %v for %d updates, job is at %d", priorities, n, job.Revision)
+	}
+	if priorities[job.Revision] != job.Priority {
+		t.Errorf("last revision has priority %d, job has %d", priorities[job.Revision], job.Priority)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/paradev-ru/peskar-hub/peskar"
+)
+
+const (
+	JournalFilename = "jobs.journal"
+
+	JournalJobPut           = "job.put"
+	JournalJobUpdate        = "job.update"
+	JournalJobDelete        = "job.delete"
+	JournalJobLog           = "job.log"
+	JournalJobLogDelete     = "job.log.delete"
+	JournalJobState         = "job.state"
+	JournalJobHistoryDelete = "job.state_history.delete"
+
+	maxJournalEntrySize = 16 * 1024 * 1024
+)
+
+// JournalEntry is one line of the journal. job.put carries the whole job,
+// job.update the job without its log and state history, which are only
+// journaled item by item.
+type JournalEntry struct {
+	Op    string                   `json:"op"`
+	At    time.Time                `json:"at"`
+	JobID string                   `json:"job_id"`
+	Job   *peskar.JobRecord        `json:"job,omitempty"`
+	Log   *peskar.LogItem          `json:"log,omitempty"`
+	State *peskar.StateHistoryItem `json:"state,omitempty"`
+}
+
+// Journal is an append-only log of job mutations made since the last
+// snapshot. It is replayed on top of jobs.json on startup and truncated
+// every time a new snapshot is written.
+type Journal struct {
+	mu       sync.Mutex
+	filename string
+	file     *os.File
+}
+
+func NewJournal(datadir string) *Journal {
+	return &Journal{
+		filename: filepath.Join(datadir, JournalFilename),
+	}
+}
+
+func (j *Journal) Open() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file != nil {
+		return nil
+	}
+	file, err := os.OpenFile(j.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("Could not open journal: %v", err)
+	}
+	j.file = file
+	return nil
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// Append writes the entries with a single sync.
+func (j *Journal) Append(entries ...JournalEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	var data []byte
+	for _, entry := range entries {
+		entry.At = now
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return fmt.Errorf("Journal '%s' is not open", j.filename)
+	}
+	if _, err := j.file.Write(data); err != nil {
+		return fmt.Errorf("Could not write to journal: %v", err)
+	}
+	return j.file.Sync()
+}
+
+func (j *Journal) Put(job peskar.Job) error {
+	record := job.Record()
+	return j.Append(JournalEntry{
+		Op:    JournalJobPut,
+		JobID: job.ID,
+		Job:   &record,
+	})
+}
+
+// Update journals the difference between old and job: the new log and
+// state history items and the rest of the job if it changed.
+func (j *Journal) Update(old, job peskar.Job) error {
+	var entries []JournalEntry
+	oldFields, err := jobFields(old)
+	if err != nil {
+		return err
+	}
+	fields, err := jobFields(job)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(oldFields, fields) {
+		update := job.Record()
+		update.Log, update.StateHistory = nil, nil
+		entries = append(entries, JournalEntry{
+			Op:    JournalJobUpdate,
+			JobID: job.ID,
+			Job:   &update,
+		})
+	}
+	history, appended := job.StateHistorySince(old)
+	if !appended {
+		entries = append(entries, JournalEntry{Op: JournalJobHistoryDelete, JobID: job.ID})
+	}
+	for i := range history {
+		entries = append(entries, JournalEntry{
+			Op:    JournalJobState,
+			JobID: job.ID,
+			State: &history[i],
+		})
+	}
+	log, appended := job.LogSince(old)
+	if !appended {
+		entries = append(entries, JournalEntry{Op: JournalJobLogDelete, JobID: job.ID})
+	}
+	for i := range log {
+		entries = append(entries, JournalEntry{
+			Op:    JournalJobLog,
+			JobID: job.ID,
+			Log:   &log[i],
+		})
+	}
+	return j.Append(entries...)
+}
+
+func jobFields(job peskar.Job) ([]byte, error) {
+	record := job.Record()
+	record.Log, record.StateHistory = nil, nil
+	return json.Marshal(record)
+}
+
+func (j *Journal) Delete(id string) error {
+	return j.Append(JournalEntry{
+		Op:    JournalJobDelete,
+		JobID: id,
+	})
+}
+
+// Replay applies journal entries to jobs and returns the number of
+// entries applied. A torn last line left by a crash is ignored.
+func (j *Journal) Replay(jobs map[string]peskar.Job) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	file, err := os.Open(j.filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var applied, line int
+	var lastErr error
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxJournalEntrySize)
+	for scanner.Scan() {
+		line++
+		if lastErr != nil {
+			logrus.Errorf("Journal entry #%d skipped: %v", line-1, lastErr)
+			lastErr = nil
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			lastErr = err
+			continue
+		}
+		applyJournalEntry(jobs, entry)
+		applied++
+	}
+	if lastErr != nil {
+		logrus.Warnf("Journal entry #%d is incomplete and was ignored", line)
+	}
+	return applied, scanner.Err()
+}
+
+// applyJournalEntry skips items the job already has, entries written
+// before a crash interrupted compaction are replayed over the new snapshot.
+func applyJournalEntry(jobs map[string]peskar.Job, entry JournalEntry) {
+	if entry.Op == JournalJobPut {
+		if entry.Job != nil {
+			jobs[entry.JobID] = entry.Job.Restore()
+		}
+		return
+	}
+	job, ok := jobs[entry.JobID]
+	if !ok {
+		return
+	}
+	record := job.Record()
+	switch entry.Op {
+	case JournalJobUpdate:
+		if entry.Job == nil {
+			return
+		}
+		update := *entry.Job
+		update.Log, update.StateHistory = record.Log, record.StateHistory
+		record = update
+	case JournalJobDelete:
+		delete(jobs, entry.JobID)
+		return
+	case JournalJobLog:
+		if entry.Log == nil {
+			return
+		}
+		for i := len(record.Log) - 1; i >= 0; i-- {
+			item := record.Log[i]
+			if item.AddedAt.Before(entry.Log.AddedAt) {
+				break
+			}
+			if item.AddedAt.Equal(entry.Log.AddedAt) && item.Message == entry.Log.Message {
+				return
+			}
+		}
+		record.Log = append(record.Log, *entry.Log)
+	case JournalJobLogDelete:
+		record.Log = []peskar.LogItem{}
+	case JournalJobState:
+		if entry.State == nil {
+			return
+		}
+		for i := len(record.StateHistory) - 1; i >= 0; i-- {
+			item := record.StateHistory[i]
+			if item.ChangedAt.Before(entry.State.ChangedAt) {
+				break
+			}
+			if item.ChangedAt.Equal(entry.State.ChangedAt) && item.ToState == entry.State.ToState {
+				return
+			}
+		}
+		record.StateHistory = append(record.StateHistory, *entry.State)
+	case JournalJobHistoryDelete:
+		record.StateHistory = []peskar.StateHistoryItem{}
+	default:
+		logrus.Errorf("Unknown journal operation '%s'", entry.Op)
+		return
+	}
+	jobs[entry.JobID] = record.Restore()
+}
+
+// Compact runs save while appends are blocked and truncates the journal
+// once save succeeds.
+func (j *Journal) Compact(save func() error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := save(); err != nil {
+		return err
+	}
+	if j.file == nil {
+		return nil
+	}
+	if err := j.file.Truncate(0); err != nil {
+		return fmt.Errorf("Could not truncate journal: %v", err)
+	}
+	return j.file.Sync()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paradev-ru/peskar-hub/peskar"
+)
+
+// reopen simulates a crash: a new hub loads the same data directory
+// without the running one saving its snapshot.
+func reopen(t *testing.T, s *Server) *Server {
+	config := *s.config
+	s2 := NewServer(BaseName, &config)
+	if err := s2.LoadData(); err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if err := s2.LoadJournal(); err != nil {
+		t.Fatal(err)
+	}
+	return s2
+}
+
+func journalLines(t *testing.T, s *Server) []JournalEntry {
+	file, err := os.Open(filepath.Join(s.config.DataDir, JournalFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func sameJobs(t *testing.T, s, s2 *Server) {
+	want, err := s.j.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s2.j.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d jobs, want %d", len(got), len(want))
+	}
+	for id, job := range want {
+		replayed := got[id]
+		g, _ := json.Marshal(replayed.Record())
+		w, _ := json.Marshal(job.Record())
+		if string(g) != string(w) {
+			t.Errorf("job '%s' replayed as\n%s\nwant\n%s", id, g, w)
+		}
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	s := testServer(t, 1)
+	ids := addTestJobs(t, s, 2)
+	if _, err := s.AddLog(ids[0], "", peskar.LogItem{Message: "Added"}); err != nil {
+		t.Fatal(err)
+	}
+	job, err := s.Dispatch(peskar.Worker{ID: "worker"})
+	if err != nil || job == nil {
+		t.Fatal(job, err)
+	}
+	if _, err := s.UpdateState(job.ID, "worker", peskar.StateWorking); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UpdateProgress(job.ID, "worker", peskar.Progress{BytesDone: 5, BytesTotal: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.j.Update(ids[0], func(job *peskar.Job) error {
+		job.DeleteLog()
+		job.Log("user", "Log cleared")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.j.Delete(ids[1], nil); err != nil {
+		t.Fatal(err)
+	}
+	sameJobs(t, s, reopen(t, s))
+}
+
+func TestJournalTornLine(t *testing.T) {
+	tests := []struct {
+		name string
+		tail string
+		jobs int
+	}{
+		{"complete", "", 2},
+		{"torn last line", `{"op":"job.put","job_id":"c","job":{"id":"c","sta`, 2},
+		{"torn line without a newline", `{`, 2},
+		{"broken line in the middle", "garbage\n" + `{"op":"job.delete","job_id":"b"}` + "\n", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer(t, 1)
+			journal := NewJournal(s.config.DataDir)
+			if err := journal.Open(); err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range []string{"a", "b"} {
+				if err := journal.Put(peskar.Job{ID: id, State: peskar.StatePending}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			journal.Close()
+			file, err := os.OpenFile(journal.filename, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file.WriteString(tt.tail)
+			file.Close()
+
+			jobs := make(map[string]peskar.Job)
+			if _, err := journal.Replay(jobs); err != nil {
+				t.Fatal(err)
+			}
+			if len(jobs) != tt.jobs {
+				t.Errorf("got %d jobs, want %d", len(jobs), tt.jobs)
+			}
+		})
+	}
+}
+
+// TestJournalDeltas checks that a progress report does not journal the
+// job log again.
+func TestJournalDeltas(t *testing.T) {
+	s := testServer(t, 1)
+	addTestJobs(t, s, 1)
+	job, err := s.Dispatch(peskar.Worker{ID: "worker"})
+	if err != nil || job == nil {
+		t.Fatal(job, err)
+	}
+	if _, err := s.UpdateState(job.ID, "worker", peskar.StateWorking); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if _, err := s.AddLog(job.ID, "worker", peskar.LogItem{Message: strings.Repeat("x", 100)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.UpdateProgress(job.ID, "worker", peskar.Progress{BytesDone: 1}); err != nil {
+		t.Fatal(err)
+	}
+	entries := journalLines(t, s)
+	last := entries[len(entries)-1]
+	if last.Op != JournalJobUpdate || last.Job == nil {
+		t.Fatalf("last entry is %+v, want %s", last, JournalJobUpdate)
+	}
+	if len(last.Job.Log) != 0 || len(last.Job.StateHistory) != 0 {
+		t.Errorf("%s entry carries %d log and %d state history items", last.Op, len(last.Job.Log), len(last.Job.StateHistory))
+	}
+	if last.Job.Progress == nil || last.Job.Progress.BytesDone != 1 {
+		t.Errorf("progress not journaled: %+v", last.Job.Progress)
+	}
+	sameJobs(t, s, reopen(t, s))
+}
+
+// TestJournalInterruptedCompaction replays a journal that was not
+// truncated after the snapshot was written.
+func TestJournalInterruptedCompaction(t *testing.T) {
+	s := testServer(t, 1)
+	ids := addTestJobs(t, s, 1)
+	for i := 0; i < 3; i++ {
+		if _, err := s.AddLog(ids[0], "", peskar.LogItem{Message: "Line"}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := s.UpdateState(ids[0], "", peskar.StateCanceled); err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := s.j.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveSnapshot(jobs); err != nil {
+		t.Fatal(err)
+	}
+	sameJobs(t, s, reopen(t, s))
+}
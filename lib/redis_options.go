@@ -0,0 +1,237 @@
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const sentinelTimeout = 5 * time.Second
+
+// RedisOptions describes how to reach Redis. Addr is a redis:// or
+// rediss:// URL; with SentinelAddrs its host is replaced by the address
+// of the current master, asked from the sentinels on every dial.
+type RedisOptions struct {
+	Addr        string
+	MaxIdle     int
+	IdleTimeout time.Duration
+
+	// Username and Password override the ones from Addr.
+	Username string
+	Password string
+
+	// TLSConfig is used with a rediss:// Addr.
+	TLSConfig *tls.Config
+
+	SentinelAddrs    []string
+	SentinelMaster   string
+	SentinelPassword string
+}
+
+type redisURL struct {
+	addr     string
+	username string
+	password string
+	db       int
+	tls      bool
+}
+
+func parseRedisURL(rawurl string) (redisURL, error) {
+	var r redisURL
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return r, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return r, fmt.Errorf("Invalid Redis URL scheme '%s'", u.Scheme)
+	}
+	r.tls = u.Scheme == "rediss"
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = u.Host
+		port = "6379"
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	r.addr = net.JoinHostPort(host, port)
+	if u.User != nil {
+		r.username = u.User.Username()
+		r.password, _ = u.User.Password()
+	}
+	path := strings.Trim(u.Path, "/")
+	if path != "" {
+		r.db, err = strconv.Atoi(path)
+		if err != nil {
+			return r, fmt.Errorf("Invalid Redis database '%s'", path)
+		}
+	}
+	return r, nil
+}
+
+// Validate checks the options without connecting.
+func (o RedisOptions) Validate() error {
+	u, err := parseRedisURL(o.Addr)
+	if err != nil {
+		return err
+	}
+	if o.TLSConfig != nil && !u.tls {
+		return errors.New("Redis TLS options require a rediss:// URL")
+	}
+	if len(o.SentinelAddrs) > 0 && o.SentinelMaster == "" {
+		return errors.New("Redis Sentinel requires a master name")
+	}
+	return nil
+}
+
+// LoadTLSConfig builds the client TLS config. Empty file names are
+// skipped: without caFile the system roots are used, without certFile
+// and keyFile no client certificate is sent.
+func LoadTLSConfig(caFile, certFile, keyFile string, skipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: skipVerify}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in '%s'", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func (o RedisOptions) dialOptions(u redisURL) []redis.DialOption {
+	options := []redis.DialOption{redis.DialUseTLS(u.tls)}
+	if u.tls && o.TLSConfig != nil {
+		options = append(options, redis.DialTLSConfig(o.TLSConfig))
+	}
+	return options
+}
+
+func (o RedisOptions) dial() (redis.Conn, error) {
+	u, err := parseRedisURL(o.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if o.Username != "" {
+		u.username = o.Username
+	}
+	if o.Password != "" {
+		u.password = o.Password
+	}
+	addr := u.addr
+	if len(o.SentinelAddrs) > 0 {
+		addr, err = o.masterAddr(u)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c, err := redis.Dial("tcp", addr, o.dialOptions(u)...)
+	if err != nil {
+		return nil, err
+	}
+	if err := auth(c, u.username, u.password); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if u.db != 0 {
+		if _, err := c.Do("SELECT", u.db); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if len(o.SentinelAddrs) > 0 {
+		if err := checkMaster(c); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// masterAddr asks the sentinels in turn for the master address.
+func (o RedisOptions) masterAddr(u redisURL) (string, error) {
+	var lastErr error
+	options := append(o.dialOptions(u),
+		redis.DialConnectTimeout(sentinelTimeout),
+		redis.DialReadTimeout(sentinelTimeout),
+		redis.DialWriteTimeout(sentinelTimeout),
+	)
+	for _, sentinel := range o.SentinelAddrs {
+		addr, err := querySentinel(sentinel, o.SentinelMaster, o.SentinelPassword, options)
+		if err == nil {
+			return addr, nil
+		}
+		lastErr = err
+	}
+	return "", fmt.Errorf("Could not get master '%s' from sentinels: %v", o.SentinelMaster, lastErr)
+}
+
+func querySentinel(sentinel, master, password string, options []redis.DialOption) (string, error) {
+	c, err := redis.Dial("tcp", sentinel, options...)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	if err := auth(c, "", password); err != nil {
+		return "", err
+	}
+	res, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", master))
+	if err == redis.ErrNil {
+		return "", fmt.Errorf("Sentinel '%s' does not know master '%s'", sentinel, master)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(res) != 2 {
+		return "", fmt.Errorf("Unexpected reply from sentinel '%s': %v", sentinel, res)
+	}
+	return net.JoinHostPort(res[0], res[1]), nil
+}
+
+func auth(c redis.Conn, username, password string) error {
+	if password == "" {
+		return nil
+	}
+	var err error
+	if username != "" {
+		_, err = c.Do("AUTH", username, password)
+	} else {
+		_, err = c.Do("AUTH", password)
+	}
+	return err
+}
+
+// checkMaster fails on a replica, e.g. a former master during failover,
+// so that the pool dials the new master instead.
+func checkMaster(c redis.Conn) error {
+	role, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(role) == 0 {
+		return errors.New("Empty ROLE reply")
+	}
+	if name, _ := redis.String(role[0], nil); name != "master" {
+		return fmt.Errorf("Redis server has role '%s', not master", name)
+	}
+	return nil
+}
@@ -1,8 +1,11 @@
 package lib
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -13,12 +16,12 @@ type RedisStore struct {
 	pool *redis.Pool
 }
 
-func NewRedis(maxIdle int, timeoutIdle time.Duration, addr string) *RedisStore {
+func NewRedis(opts RedisOptions) *RedisStore {
 	var pool = &redis.Pool{
-		MaxIdle:     maxIdle,
-		IdleTimeout: timeoutIdle,
+		MaxIdle:     opts.MaxIdle,
+		IdleTimeout: opts.IdleTimeout,
 		Dial: func() (redis.Conn, error) {
-			c, err := redis.DialURL(addr)
+			c, err := opts.dial()
 			if err != nil {
 				return nil, err
 			}
@@ -29,6 +32,9 @@ func NewRedis(maxIdle int, timeoutIdle time.Duration, addr string) *RedisStore {
 			return c, err
 		},
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if len(opts.SentinelAddrs) > 0 {
+				return checkMaster(c)
+			}
 			if _, err := c.Do("PING"); err != nil {
 				return err
 			}
@@ -44,6 +50,10 @@ func (r *RedisStore) Check() error {
 	return conn.Err()
 }
 
+func (r *RedisStore) Conn() redis.Conn {
+	return r.pool.Get()
+}
+
 func (r *RedisStore) Flush() error {
 	conn := r.pool.Get()
 	defer conn.Close()
@@ -64,20 +74,71 @@ func (r *RedisStore) Send(channel string, value interface{}) error {
 	return err
 }
 
+// SubscribeState describes the connection of a subscriber.
+type SubscribeState struct {
+	Connected bool      `json:"connected"`
+	Since     time.Time `json:"since,omitempty"`
+	Attempts  int       `json:"attempts,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type connState struct {
+	mu    sync.Mutex
+	state SubscribeState
+}
+
+func (c *connState) State() SubscribeState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+func (c *connState) setConnected() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.state.Connected {
+		c.state = SubscribeState{
+			Connected: true,
+			Since:     time.Now().UTC(),
+		}
+	}
+}
+
+func (c *connState) setError(err error, attempts int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state.Connected || c.state.Since.IsZero() {
+		c.state.Since = time.Now().UTC()
+	}
+	c.state.Connected = false
+	c.state.Attempts = attempts
+	c.state.LastError = err.Error()
+}
+
+// Subscribe listens to several channels and patterns on one connection.
+// Messages of a channel without its own callback go to
+// SuccessReceivedCallback. Callbacks must be set before Run.
 type Subscribe struct {
+	connState
 	pool *redis.Pool
 
-	Channel                       string
-	RetryingPolicyCallback        func(attempts int, duration time.Duration) error
+	channels map[string]func(result []byte) error
+	patterns map[string]func(channel string, result []byte) error
+
+	RetryingPolicyCallback        func(ctx context.Context, attempts int, duration time.Duration) error
 	SuccessReceivedCallback       func(result []byte) error
 	ConnectionEstablishedCallback func(duration time.Duration) error
 }
 
-func (r *RedisStore) NewSubscribe(channel string) *Subscribe {
+func (r *RedisStore) NewSubscribe(channels ...string) *Subscribe {
 	s := new(Subscribe)
 
 	s.pool = r.pool
-	s.Channel = channel
+	s.channels = make(map[string]func(result []byte) error)
+	s.patterns = make(map[string]func(channel string, result []byte) error)
+	for _, channel := range channels {
+		s.channels[channel] = nil
+	}
 	s.RetryingPolicyCallback = basicRetryingPolicyCallback
 	s.SuccessReceivedCallback = basicSuccessReveivedCallback
 	s.ConnectionEstablishedCallback = basicConnectionEstablishedCallback
@@ -85,50 +146,149 @@ func (r *RedisStore) NewSubscribe(channel string) *Subscribe {
 	return s
 }
 
-func (s *Subscribe) Run() error {
+// Handle subscribes to the channel with its own callback.
+func (s *Subscribe) Handle(channel string, callback func(result []byte) error) {
+	s.channels[channel] = callback
+}
+
+// HandlePattern subscribes to the channels matching the pattern.
+func (s *Subscribe) HandlePattern(pattern string, callback func(channel string, result []byte) error) {
+	s.patterns[pattern] = callback
+}
+
+// Channels returns the subscribed channels and patterns.
+func (s *Subscribe) Channels() []string {
+	var channels []string
+	for channel := range s.channels {
+		channels = append(channels, channel)
+	}
+	for pattern := range s.patterns {
+		channels = append(channels, pattern)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// Run receives messages and reconnects until ctx is done or
+// RetryingPolicyCallback gives up.
+func (s *Subscribe) Run(ctx context.Context) error {
 	var attempts int
 	var errStartTime time.Time
-WAIT:
 	for {
-		conn := s.pool.Get()
-		defer conn.Close()
+		var stop error
+		err := s.receive(ctx, func() error {
+			s.setConnected()
+			if attempts > 0 {
+				attempts = 0
+				stop = s.ConnectionEstablishedCallback(time.Since(errStartTime))
+			}
+			return stop
+		})
+		if stop != nil {
+			return stop
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
 
-		psc := redis.PubSubConn{conn}
-		err := psc.Subscribe(s.Channel)
+		if attempts == 0 {
+			errStartTime = time.Now()
+		}
 
-		if conn.Err() == nil && err == nil && attempts > 0 {
-			attempts = 0
-			if err := s.ConnectionEstablishedCallback(time.Since(errStartTime)); err != nil {
-				return err
-			}
+		logrus.Errorf("Redis connection refused: %+v", err)
+
+		attempts++
+		s.setError(err, attempts)
+
+		if err := s.RetryingPolicyCallback(ctx, attempts, time.Since(errStartTime)); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
 		}
+	}
+}
 
-		for {
-			switch v := psc.Receive().(type) {
-			case redis.Message:
-				if err := s.SuccessReceivedCallback(v.Data); err != nil {
-					logrus.Error(err)
-				}
-			case error:
-				if attempts == 0 {
-					errStartTime = time.Now()
-				}
+// receive subscribes on a new connection and dispatches messages until
+// the connection fails or ctx is done.
+func (s *Subscribe) receive(ctx context.Context, subscribed func() error) error {
+	conn := s.pool.Get()
+	defer conn.Close()
 
-				logrus.Errorf("Redis connection refused: %+v", v)
-				psc.Close()
+	psc := redis.PubSubConn{Conn: conn}
+	if err := s.subscribe(psc); err != nil {
+		return err
+	}
 
-				attempts++
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	defer func() {
+		close(done)
+		<-stopped
+	}()
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			psc.Unsubscribe()
+			psc.PUnsubscribe()
+		case <-done:
+		}
+	}()
 
-				err := s.RetryingPolicyCallback(attempts, time.Since(errStartTime))
-				if err != nil {
+	total := len(s.channels) + len(s.patterns)
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Subscription:
+			if v.Count == 0 {
+				if err := ctx.Err(); err != nil {
 					return err
 				}
-
-				goto WAIT
+				return errors.New("Unsubscribed from all channels")
 			}
+			if (v.Kind == "subscribe" || v.Kind == "psubscribe") && v.Count == total {
+				if err := subscribed(); err != nil {
+					return err
+				}
+			}
+		case redis.Message:
+			callback := s.channels[v.Channel]
+			if callback == nil {
+				callback = s.SuccessReceivedCallback
+			}
+			if err := callback(v.Data); err != nil {
+				logrus.Error(err)
+			}
+		case redis.PMessage:
+			if callback := s.patterns[v.Pattern]; callback != nil {
+				if err := callback(v.Channel, v.Data); err != nil {
+					logrus.Error(err)
+				}
+			}
+		case error:
+			return v
 		}
 	}
+}
 
+func (s *Subscribe) subscribe(psc redis.PubSubConn) error {
+	var channels, patterns []interface{}
+	for channel := range s.channels {
+		channels = append(channels, channel)
+	}
+	for pattern := range s.patterns {
+		patterns = append(patterns, pattern)
+	}
+	if len(channels) > 0 {
+		if err := psc.Subscribe(channels...); err != nil {
+			return err
+		}
+	}
+	if len(patterns) > 0 {
+		if err := psc.PSubscribe(patterns...); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -137,13 +297,16 @@ func basicConnectionEstablishedCallback(duration time.Duration) error {
 	return nil
 }
 
-func basicRetryingPolicyCallback(attempts int, duration time.Duration) error {
+func basicRetryingPolicyCallback(ctx context.Context, attempts int, duration time.Duration) error {
 	if duration >= 30*time.Minute {
 		return errors.New("Redis connection refused for a 30 minutes, shutting down.")
 	}
 
 	logrus.Debugf("Wait Redis for a 10 seconds (#%d, %v)", attempts, duration)
-	time.Sleep(10 * time.Second)
+	select {
+	case <-ctx.Done():
+	case <-time.After(10 * time.Second):
+	}
 
 	return nil
 }
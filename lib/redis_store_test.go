@@ -0,0 +1,200 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func testRedis(t *testing.T) (*miniredis.Miniredis, *RedisStore) {
+	m := miniredis.RunT(t)
+	return m, NewRedis(RedisOptions{Addr: "redis://" + m.Addr(), MaxIdle: 1})
+}
+
+// runSubscribe runs s until the test ends and waits for it to subscribe.
+func runSubscribe(t *testing.T, s *Subscribe) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run returned %v after cancel", err)
+		}
+	})
+	waitConnected(t, s)
+}
+
+func waitConnected(t *testing.T, s *Subscribe) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.State().Connected {
+		if time.Now().After(deadline) {
+			t.Fatalf("Not subscribed: %+v", s.State())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// receiveMessages returns n messages sorted, Redis does not keep the
+// order of messages delivered to channels and patterns.
+func receiveMessages(t *testing.T, ch <-chan string, n int) string {
+	var messages []string
+	for i := 0; i < n; i++ {
+		select {
+		case v := <-ch:
+			messages = append(messages, v)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Received %v, want %d messages", messages, n)
+		}
+	}
+	sort.Strings(messages)
+	return strings.Join(messages, ", ")
+}
+
+func TestSubscribeDispatch(t *testing.T) {
+	m, r := testRedis(t)
+	received := make(chan string, 10)
+	s := r.NewSubscribe("default")
+	s.SuccessReceivedCallback = func(result []byte) error {
+		received <- "default: " + string(result)
+		return nil
+	}
+	s.Handle("jobs", func(result []byte) error {
+		received <- "jobs: " + string(result)
+		return nil
+	})
+	s.HandlePattern("job.*", func(channel string, result []byte) error {
+		received <- "job.*: " + channel + " " + string(result)
+		return nil
+	})
+	if got := s.Channels(); len(got) != 3 || got[0] != "default" || got[1] != "job.*" || got[2] != "jobs" {
+		t.Errorf("Channels() = %v", got)
+	}
+	runSubscribe(t, s)
+
+	m.Publish("other", "ignored")
+	m.Publish("default", "a")
+	m.Publish("jobs", "b")
+	m.Publish("job.log", "c")
+	m.Publish("job.events", "d")
+	want := "default: a, job.*: job.events d, job.*: job.log c, jobs: b"
+	if got := receiveMessages(t, received, 4); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestSubscribeHandlerError checks that a failing callback neither stops
+// the subscriber nor makes it reconnect.
+func TestSubscribeHandlerError(t *testing.T) {
+	m, r := testRedis(t)
+	received := make(chan string, 10)
+	s := r.NewSubscribe()
+	s.Handle("jobs", func(result []byte) error {
+		received <- string(result)
+		return errors.New("broken message")
+	})
+	s.HandlePattern("job.*", func(channel string, result []byte) error {
+		received <- string(result)
+		return errors.New("broken message")
+	})
+	runSubscribe(t, s)
+
+	m.Publish("jobs", "a")
+	m.Publish("job.log", "b")
+	m.Publish("jobs", "c")
+	if got := receiveMessages(t, received, 3); got != "a, b, c" {
+		t.Errorf("got %q", got)
+	}
+	if state := s.State(); !state.Connected || state.Attempts != 0 {
+		t.Errorf("state after handler errors %+v", state)
+	}
+}
+
+func TestSubscribeReconnect(t *testing.T) {
+	m, r := testRedis(t)
+	received := make(chan string, 10)
+	reconnected := make(chan time.Duration, 1)
+	var retries []int
+	s := r.NewSubscribe()
+	s.Handle("jobs", func(result []byte) error {
+		received <- string(result)
+		return nil
+	})
+	s.HandlePattern("job.*", func(channel string, result []byte) error {
+		received <- string(result)
+		return nil
+	})
+	s.RetryingPolicyCallback = func(ctx context.Context, attempts int, duration time.Duration) error {
+		retries = append(retries, attempts)
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}
+	s.ConnectionEstablishedCallback = func(duration time.Duration) error {
+		reconnected <- duration
+		return nil
+	}
+	runSubscribe(t, s)
+
+	m.Publish("jobs", "before")
+	if got := receiveMessages(t, received, 1); got != "before" {
+		t.Errorf("got %q before the restart", got)
+	}
+
+	m.Close()
+	if err := m.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Not reconnected: %+v", s.State())
+	}
+	if len(retries) == 0 || retries[0] != 1 {
+		t.Errorf("retry attempts %v", retries)
+	}
+	if state := s.State(); !state.Connected || state.Attempts != 0 || state.LastError != "" {
+		t.Errorf("state after reconnect %+v", state)
+	}
+
+	m.Publish("jobs", "after")
+	m.Publish("job.log", "pattern after")
+	if got := receiveMessages(t, received, 2); got != "after, pattern after" {
+		t.Errorf("got %q after the restart", got)
+	}
+}
+
+// TestSubscribeGiveUp checks that Run returns the error of
+// RetryingPolicyCallback.
+func TestSubscribeGiveUp(t *testing.T) {
+	m, r := testRedis(t)
+	s := r.NewSubscribe("jobs")
+	giveUp := errors.New("give up")
+	s.RetryingPolicyCallback = func(ctx context.Context, attempts int, duration time.Duration) error {
+		return giveUp
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(context.Background())
+	}()
+	waitConnected(t, s)
+
+	m.Close()
+	select {
+	case err := <-done:
+		if err != giveUp {
+			t.Errorf("Run returned %v, want %v", err, giveUp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return")
+	}
+	if state := s.State(); state.Connected || state.Attempts != 1 || state.LastError == "" {
+		t.Errorf("state after giving up %+v", state)
+	}
+}
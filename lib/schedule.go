@@ -0,0 +1,270 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	HolidayLayout = "2006-01-02"
+
+	minutesPerDay = 24 * 60
+	lookaheadDays = 8
+)
+
+// Window is a do-not-disturb interval in minutes since midnight. A window
+// with End not after Start lasts until End on the next day.
+type Window struct {
+	Start int
+	End   int
+}
+
+func ParseWindow(s string) (Window, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return Window{}, fmt.Errorf("Window '%s' must look like 'HH:MM-HH:MM'", s)
+	}
+	start, err := parseClock(parts[0])
+	if err != nil {
+		return Window{}, err
+	}
+	end, err := parseClock(parts[1])
+	if err != nil {
+		return Window{}, err
+	}
+	return Window{start, end}, nil
+}
+
+func parseClock(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(strings.TrimSpace(s), "%d:%d", &h, &m); err != nil {
+		return 0, fmt.Errorf("Invalid time '%s': %v", s, err)
+	}
+	if h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("Invalid time '%s'", s)
+	}
+	return h*60 + m, nil
+}
+
+func (w Window) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60)
+}
+
+func (w Window) MarshalJSON() ([]byte, error) {
+	return json.Marshal(w.String())
+}
+
+func (w *Window) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := ParseWindow(s)
+	if err != nil {
+		return err
+	}
+	*w = v
+	return nil
+}
+
+// Schedule describes when the do-not-disturb mode is on. Windows apply to
+// every day unless Weekdays has an entry for that day, in which case the
+// entry replaces them (an empty entry means no dnd that day). No windows
+// start on Holidays.
+type Schedule struct {
+	Location *time.Location
+	Windows  []Window
+	Weekdays map[time.Weekday][]Window
+	Holidays map[string]bool
+}
+
+type scheduleFile struct {
+	TimeZone string              `json:"time_zone,omitempty"`
+	Windows  []Window            `json:"windows"`
+	Weekdays map[string][]Window `json:"weekdays,omitempty"`
+	Holidays []string            `json:"holidays,omitempty"`
+}
+
+// NewHourlySchedule builds the schedule of the -dnd-start and -dnd-end
+// flags: dnd from the start hour till the end of the end hour on weekdays.
+func NewHourlySchedule(dndStart, dndStop int, loc *time.Location) *Schedule {
+	window := []Window{{dndStart * 60, ((dndStop + 1) * 60) % minutesPerDay}}
+	return &Schedule{
+		Location: loc,
+		Windows:  window,
+		Weekdays: map[time.Weekday][]Window{
+			time.Saturday: {},
+			time.Sunday:   {},
+		},
+	}
+}
+
+func LoadSchedule(filename string) (*Schedule, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	s := &Schedule{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("Schedule '%s': %v", filename, err)
+	}
+	return s, nil
+}
+
+func parseWeekday(name string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), name) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown weekday '%s'", name)
+}
+
+func (s *Schedule) UnmarshalJSON(data []byte) error {
+	var f scheduleFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	loc := time.Local
+	if f.TimeZone != "" {
+		var err error
+		loc, err = time.LoadLocation(f.TimeZone)
+		if err != nil {
+			return err
+		}
+	}
+	v := Schedule{
+		Location: loc,
+		Windows:  f.Windows,
+		Weekdays: make(map[time.Weekday][]Window),
+		Holidays: make(map[string]bool),
+	}
+	for name, windows := range f.Weekdays {
+		d, err := parseWeekday(name)
+		if err != nil {
+			return err
+		}
+		if windows == nil {
+			windows = []Window{}
+		}
+		v.Weekdays[d] = windows
+	}
+	for _, day := range f.Holidays {
+		if _, err := time.Parse(HolidayLayout, day); err != nil {
+			return fmt.Errorf("Invalid holiday '%s': %v", day, err)
+		}
+		v.Holidays[day] = true
+	}
+	*s = v
+	return nil
+}
+
+func (s *Schedule) MarshalJSON() ([]byte, error) {
+	f := scheduleFile{
+		TimeZone: s.location().String(),
+		Windows:  s.Windows,
+	}
+	if f.Windows == nil {
+		f.Windows = []Window{}
+	}
+	if len(s.Weekdays) > 0 {
+		f.Weekdays = make(map[string][]Window)
+		for d, windows := range s.Weekdays {
+			if windows == nil {
+				windows = []Window{}
+			}
+			f.Weekdays[strings.ToLower(d.String())] = windows
+		}
+	}
+	for day := range s.Holidays {
+		f.Holidays = append(f.Holidays, day)
+	}
+	sort.Strings(f.Holidays)
+	return json.Marshal(f)
+}
+
+func (s *Schedule) location() *time.Location {
+	if s.Location == nil {
+		return time.Local
+	}
+	return s.Location
+}
+
+func (s *Schedule) dayWindows(day time.Time) []Window {
+	if s.Holidays[day.Format(HolidayLayout)] {
+		return nil
+	}
+	if windows, ok := s.Weekdays[day.Weekday()]; ok {
+		return windows
+	}
+	return s.Windows
+}
+
+type span struct {
+	start, end time.Time
+}
+
+type byStart []span
+
+func (a byStart) Len() int           { return len(a) }
+func (a byStart) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byStart) Less(i, j int) bool { return a[i].start.Before(a[j].start) }
+
+// spans returns merged dnd intervals starting from the day before t.
+func (s *Schedule) spans(t time.Time) []span {
+	t = t.In(s.location())
+	year, month, day := t.Date()
+	var spans []span
+	for i := -1; i <= lookaheadDays; i++ {
+		date := time.Date(year, month, day+i, 0, 0, 0, 0, s.location())
+		for _, w := range s.dayWindows(date) {
+			start := time.Date(year, month, day+i, 0, w.Start, 0, 0, s.location())
+			endDay := day + i
+			if w.End <= w.Start {
+				endDay++
+			}
+			end := time.Date(year, month, endDay, 0, w.End, 0, 0, s.location())
+			spans = append(spans, span{start, end})
+		}
+	}
+	sort.Sort(byStart(spans))
+	var merged []span
+	for _, sp := range spans {
+		if n := len(merged); n > 0 && !sp.start.After(merged[n-1].end) {
+			if sp.end.After(merged[n-1].end) {
+				merged[n-1].end = sp.end
+			}
+			continue
+		}
+		merged = append(merged, sp)
+	}
+	return merged
+}
+
+func (s *Schedule) IsAvailable(t time.Time) bool {
+	for _, sp := range s.spans(t) {
+		if !t.Before(sp.start) && t.Before(sp.end) {
+			return false
+		}
+	}
+	return true
+}
+
+// NextTransition returns the moment after t when availability changes,
+// or zero time if it does not change within the next week.
+func (s *Schedule) NextTransition(t time.Time) time.Time {
+	for _, sp := range s.spans(t) {
+		if !t.Before(sp.end) {
+			continue
+		}
+		if t.Before(sp.start) {
+			return sp.start
+		}
+		return sp.end
+	}
+	return time.Time{}
+}
@@ -0,0 +1,155 @@
+package lib
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+const testSchedule = `{
+	"time_zone": "Europe/Moscow",
+	"windows": ["22:00-06:00"],
+	"weekdays": {"saturday": [], "sunday": ["12:00-14:00"]},
+	"holidays": ["2026-10-14"]
+}`
+
+func parseTime(t *testing.T, loc *time.Location, value string) time.Time {
+	v, err := time.ParseInLocation("2006-01-02 15:04", value, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestScheduleIsAvailable(t *testing.T) {
+	var s Schedule
+	if err := json.Unmarshal([]byte(testSchedule), &s); err != nil {
+		t.Fatal(err)
+	}
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		loc       *time.Location
+		at        string
+		available bool
+		next      string
+	}{
+		{"monday evening", moscow, "2026-10-12 21:59", true, "2026-10-12 22:00"},
+		{"window starts", moscow, "2026-10-12 22:00", false, "2026-10-13 06:00"},
+		{"before midnight", moscow, "2026-10-12 23:30", false, "2026-10-13 06:00"},
+		{"after midnight", moscow, "2026-10-13 05:59", false, "2026-10-13 06:00"},
+		{"window ends", moscow, "2026-10-13 06:00", true, "2026-10-13 22:00"},
+		{"morning after the eve of a holiday", moscow, "2026-10-14 05:00", false, "2026-10-14 06:00"},
+		{"holiday night", moscow, "2026-10-14 23:00", true, "2026-10-15 22:00"},
+		{"friday night into saturday", moscow, "2026-10-17 05:00", false, "2026-10-17 06:00"},
+		{"saturday night", moscow, "2026-10-17 23:00", true, "2026-10-18 12:00"},
+		{"sunday window", moscow, "2026-10-18 13:00", false, "2026-10-18 14:00"},
+		{"sunday night", moscow, "2026-10-18 23:00", true, "2026-10-19 22:00"},
+		{"utc inside the window", time.UTC, "2026-10-12 20:30", false, "2026-10-13 03:00"},
+		{"utc before the window", time.UTC, "2026-10-12 18:30", true, "2026-10-12 19:00"},
+	}
+	for _, tt := range tests {
+		at := parseTime(t, tt.loc, tt.at)
+		if got := s.IsAvailable(at); got != tt.available {
+			t.Errorf("%s: IsAvailable(%v) = %v, want %v", tt.name, at, got, tt.available)
+		}
+		next := parseTime(t, tt.loc, tt.next)
+		if got := s.NextTransition(at); !got.Equal(next) {
+			t.Errorf("%s: NextTransition(%v) = %v, want %v", tt.name, at, got, next)
+		}
+	}
+}
+
+func TestHourlySchedule(t *testing.T) {
+	tests := []struct {
+		name      string
+		start     int
+		end       int
+		at        string
+		available bool
+	}{
+		{"inside", 1, 5, "2026-10-12 03:00", false},
+		{"end hour is included", 1, 5, "2026-10-12 05:59", false},
+		{"after", 1, 5, "2026-10-12 06:00", true},
+		{"wraps midnight", 23, 5, "2026-10-13 00:30", false},
+		{"before wrap", 23, 5, "2026-10-12 22:59", true},
+		{"weekend", 1, 5, "2026-10-17 03:00", true},
+		{"friday night", 23, 5, "2026-10-17 02:00", false},
+	}
+	for _, tt := range tests {
+		s := NewHourlySchedule(tt.start, tt.end, time.UTC)
+		at := parseTime(t, time.UTC, tt.at)
+		if got := s.IsAvailable(at); got != tt.available {
+			t.Errorf("%s: IsAvailable(%v) = %v, want %v", tt.name, at, got, tt.available)
+		}
+	}
+}
+
+func TestScheduleWithoutWindows(t *testing.T) {
+	s := &Schedule{Location: time.UTC}
+	at := parseTime(t, time.UTC, "2026-10-12 03:00")
+	if !s.IsAvailable(at) {
+		t.Error("empty schedule is not available")
+	}
+	if next := s.NextTransition(at); !next.IsZero() {
+		t.Errorf("NextTransition = %v, want zero time", next)
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Window
+		ok    bool
+	}{
+		{"22:00-06:00", Window{22 * 60, 6 * 60}, true},
+		{"00:00-24:00", Window{0, 24 * 60}, true},
+		{" 9:30 - 18:15 ", Window{9*60 + 30, 18*60 + 15}, true},
+		{"22:00", Window{}, false},
+		{"25:00-06:00", Window{}, false},
+		{"22:60-06:00", Window{}, false},
+		{"24:30-06:00", Window{}, false},
+		{"ab-cd", Window{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseWindow(tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseWindow(%q) error = %v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseWindow(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleJSON(t *testing.T) {
+	var s Schedule
+	if err := json.Unmarshal([]byte(testSchedule), &s); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(&s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var again Schedule
+	if err := json.Unmarshal(data, &again); err != nil {
+		t.Fatal(err)
+	}
+	if again.Location.String() != "Europe/Moscow" || len(again.Weekdays) != 2 || !again.Holidays["2026-10-14"] {
+		t.Errorf("schedule changed after a round trip: %s", data)
+	}
+	for _, bad := range []string{
+		`{"weekdays": {"someday": []}}`,
+		`{"time_zone": "Mars/Olympus"}`,
+		`{"holidays": ["14.10.2026"]}`,
+		`{"windows": ["22:00"]}`,
+	} {
+		if err := json.Unmarshal([]byte(bad), &Schedule{}); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// StreamField is the stream entry field holding the JSON message.
+	StreamField = "data"
+
+	streamReadCount  = 100
+	streamBlock      = 5 * time.Second
+	streamRetryDelay = 30 * time.Second
+)
+
+// PermanentError is returned by SuccessReceivedCallback for entries that
+// would fail again, e.g. malformed ones. They are acknowledged, other
+// failed entries stay pending and are delivered again.
+type PermanentError struct {
+	Err error
+}
+
+func (e PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func Permanent(err error) error {
+	return PermanentError{err}
+}
+
+// Append adds the value to the stream, trimming the stream to about
+// maxLen entries.
+func (r *RedisStore) Append(stream string, maxLen int, value interface{}) error {
+	res, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("XADD", stream, "MAXLEN", "~", maxLen, "*", StreamField, string(res))
+	return err
+}
+
+// StreamConsumer reads a stream through a consumer group. Each entry is
+// acknowledged once the callback handles it or returns a PermanentError.
+// Entries read but not handled, after a failure or before a restart, are
+// claimed from the group and delivered again after streamRetryDelay.
+type StreamConsumer struct {
+	connState
+	pool *redis.Pool
+
+	Stream                        string
+	Group                         string
+	Consumer                      string
+	RetryingPolicyCallback        func(ctx context.Context, attempts int, duration time.Duration) error
+	SuccessReceivedCallback       func(result []byte) error
+	ConnectionEstablishedCallback func(duration time.Duration) error
+}
+
+type streamEntry struct {
+	ID   string
+	Data []byte
+}
+
+func (r *RedisStore) NewStreamConsumer(stream, group, consumer string) *StreamConsumer {
+	c := new(StreamConsumer)
+
+	c.pool = r.pool
+	c.Stream = stream
+	c.Group = group
+	c.Consumer = consumer
+	c.RetryingPolicyCallback = basicRetryingPolicyCallback
+	c.SuccessReceivedCallback = basicSuccessReveivedCallback
+	c.ConnectionEstablishedCallback = basicConnectionEstablishedCallback
+
+	return c
+}
+
+// Channels returns the stream name.
+func (c *StreamConsumer) Channels() []string {
+	return []string{c.Stream}
+}
+
+// Run reads the stream and reconnects until ctx is done or
+// RetryingPolicyCallback gives up.
+func (c *StreamConsumer) Run(ctx context.Context) error {
+	var attempts int
+	var errStartTime time.Time
+	for {
+		conn := c.pool.Get()
+		err := c.createGroup(conn)
+		if err == nil {
+			c.setConnected()
+			if attempts > 0 {
+				attempts = 0
+				if err := c.ConnectionEstablishedCallback(time.Since(errStartTime)); err != nil {
+					conn.Close()
+					return err
+				}
+			}
+			err = c.read(ctx, conn)
+		}
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if attempts == 0 {
+			errStartTime = time.Now()
+		}
+
+		logrus.Errorf("Redis connection refused: %+v", err)
+
+		attempts++
+		c.setError(err, attempts)
+
+		if err := c.RetryingPolicyCallback(ctx, attempts, time.Since(errStartTime)); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// createGroup creates the group reading the stream from the beginning,
+// so that entries added before the first start are not skipped.
+func (c *StreamConsumer) createGroup(conn redis.Conn) error {
+	_, err := conn.Do("XGROUP", "CREATE", c.Stream, c.Group, "0", "MKSTREAM")
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+// read handles the pending entries of the consumer first, then the new
+// ones, going back to the pending entries every streamRetryDelay. It
+// returns on a connection error or when ctx is done.
+func (c *StreamConsumer) read(ctx context.Context, conn redis.Conn) error {
+	id := "0"
+	claimedAt := time.Now()
+	for ctx.Err() == nil {
+		if id == ">" && time.Since(claimedAt) >= streamRetryDelay {
+			claimedAt = time.Now()
+			n, err := c.claim(conn)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				id = "0"
+			}
+		}
+		reply, err := redis.Values(conn.Do("XREADGROUP", "GROUP", c.Group, c.Consumer,
+			"COUNT", streamReadCount, "BLOCK", int64(streamBlock/time.Millisecond),
+			"STREAMS", c.Stream, id))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		entries, err := streamEntries(reply)
+		if err != nil {
+			return err
+		}
+		if id != ">" && len(entries) == 0 {
+			id = ">"
+			continue
+		}
+		for _, e := range entries {
+			// Pending entries are read past, failed ones stay pending
+			// until the next claim.
+			if id != ">" {
+				id = e.ID
+			}
+			// Pending entries trimmed from the stream come without data.
+			if e.Data != nil {
+				if err := c.SuccessReceivedCallback(e.Data); err != nil {
+					logrus.Error(err)
+					if _, ok := err.(PermanentError); !ok {
+						continue
+					}
+				}
+			}
+			if _, err := conn.Do("XACK", c.Stream, c.Group, e.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// claim takes over the entries of the group pending for longer than
+// streamRetryDelay, failed here or read by a consumer that is gone, and
+// returns their number.
+func (c *StreamConsumer) claim(conn redis.Conn) (int, error) {
+	reply, err := redis.Values(conn.Do("XPENDING", c.Stream, c.Group, "-", "+", streamReadCount))
+	if err != nil {
+		return 0, err
+	}
+	minIdle := int64(streamRetryDelay / time.Millisecond)
+	args := redis.Args{}.Add(c.Stream, c.Group, c.Consumer, minIdle)
+	var n int
+	for _, item := range reply {
+		values, err := redis.Values(item, nil)
+		if err != nil || len(values) != 4 {
+			return 0, errors.New("Unexpected XPENDING reply")
+		}
+		idle, err := redis.Int64(values[2], nil)
+		if err != nil {
+			return 0, err
+		}
+		if idle >= minIdle {
+			args = args.Add(values[0])
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	_, err = conn.Do("XCLAIM", args.Add("JUSTID")...)
+	return n, err
+}
+
+func streamEntries(reply []interface{}) ([]streamEntry, error) {
+	var entries []streamEntry
+	for _, s := range reply {
+		stream, err := redis.Values(s, nil)
+		if err != nil || len(stream) != 2 {
+			return nil, errors.New("Unexpected XREADGROUP reply")
+		}
+		items, err := redis.Values(stream[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			values, err := redis.Values(item, nil)
+			if err != nil || len(values) != 2 {
+				return nil, errors.New("Unexpected stream entry")
+			}
+			id, err := redis.String(values[0], nil)
+			if err != nil {
+				return nil, err
+			}
+			entry := streamEntry{ID: id}
+			fields, err := redis.StringMap(values[1], nil)
+			if err != nil && err != redis.ErrNil {
+				return nil, err
+			}
+			if data, ok := fields[StreamField]; ok {
+				entry.Data = []byte(data)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
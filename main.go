@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -25,6 +26,13 @@ func main() {
 		logrus.Fatal(err.Error())
 	}
 
+	if printConfig {
+		if err := config.Print(os.Stdout); err != nil {
+			logrus.Fatal(err.Error())
+		}
+		os.Exit(0)
+	}
+
 	logrus.Infof("Starting %s", BaseName)
 	logrus.Infof("HTTP listening on %s", config.ListenAddr)
 
@@ -39,19 +47,37 @@ func main() {
 		logrus.Error(err)
 	}
 
-	go s.Subscribe()
-	go s.Work()
-
+	ctx, cancel := context.WithCancel(context.Background())
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
-	for {
-		select {
-		case sign := <-signalChan:
-			logrus.Info(fmt.Sprintf("Captured %v. Exiting...", sign))
-			if err := s.Shutdown(); err != nil {
-				logrus.Panic(err)
+	go func() {
+		sign := <-signalChan
+		logrus.Info(fmt.Sprintf("Captured %v. Exiting...", sign))
+		cancel()
+		sign = <-signalChan
+		logrus.Errorf("Captured %v again. Exiting without graceful shutdown", sign)
+		os.Exit(1)
+	}()
+
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	go func() {
+		for range reloadChan {
+			logrus.Info("Captured SIGHUP. Reloading config...")
+			if err := s.ReloadConfig(); err != nil {
+				logrus.Errorf("Config not reloaded: %v", err)
 			}
-			os.Exit(0)
 		}
+	}()
+
+	workErr := s.Work(ctx)
+	if workErr != nil {
+		logrus.Error(workErr)
+	}
+	if err := s.Shutdown(); err != nil {
+		logrus.Panic(err)
+	}
+	if workErr != nil {
+		os.Exit(1)
 	}
 }
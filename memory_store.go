@@ -0,0 +1,278 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/paradev-ru/peskar-hub/peskar"
+)
+
+// MemoryJobStore keeps jobs in memory. Mutations are written to the
+// journal, if any, before the store lock is released, so the journal
+// has them in the order they were made.
+type MemoryJobStore struct {
+	mu      sync.RWMutex
+	jobs    map[string]peskar.Job
+	journal *Journal
+}
+
+func NewMemoryJobStore(journal *Journal) *MemoryJobStore {
+	return &MemoryJobStore{
+		jobs:    make(map[string]peskar.Job),
+		journal: journal,
+	}
+}
+
+func (m *MemoryJobStore) put(old *peskar.Job, job *peskar.Job) {
+	if old != nil {
+		if _, err := bumpRevision(old, job); err != nil {
+			logrus.Error(err)
+		}
+	}
+	m.jobs[job.ID] = *job
+	if m.journal == nil {
+		return
+	}
+	var err error
+	if old == nil {
+		err = m.journal.Put(*job)
+	} else {
+		err = m.journal.Update(*old, *job)
+	}
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (m *MemoryJobStore) Get(id string) (peskar.Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return peskar.Job{}, ErrJobNotFound
+	}
+	return job, nil
+}
+
+func (m *MemoryJobStore) List() ([]peskar.Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	jobList := make([]peskar.Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobList = append(jobList, job)
+	}
+	return jobList, nil
+}
+
+func (m *MemoryJobStore) Add(job peskar.Job, check func(existing peskar.Job) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if check != nil {
+		for _, existing := range m.jobs {
+			if err := check(existing); err != nil {
+				return err
+			}
+		}
+	}
+	m.put(nil, &job)
+	return nil
+}
+
+func (m *MemoryJobStore) Update(id string, fn func(job *peskar.Job) error) (peskar.Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, ok := m.jobs[id]
+	if !ok {
+		return peskar.Job{}, ErrJobNotFound
+	}
+	job := old
+	if err := fn(&job); err != nil {
+		return peskar.Job{}, err
+	}
+	m.put(&old, &job)
+	return job, nil
+}
+
+func (m *MemoryJobStore) UpdateFirst(check func(jobs []peskar.Job) error, fn func(job *peskar.Job) bool) (*peskar.Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobList := make([]peskar.Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobList = append(jobList, job)
+	}
+	if check != nil {
+		if err := check(jobList); err != nil {
+			return nil, err
+		}
+	}
+	peskar.QueueOrder(jobList)
+	for _, old := range jobList {
+		job := old
+		if fn(&job) {
+			m.put(&old, &job)
+			return &job, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemoryJobStore) UpdateAll(fn func(job *peskar.Job) bool) ([]peskar.Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var updated []peskar.Job
+	for _, old := range m.jobs {
+		job := old
+		if fn(&job) {
+			m.put(&old, &job)
+			updated = append(updated, job)
+		}
+	}
+	return updated, nil
+}
+
+func (m *MemoryJobStore) Delete(id string, check func(job peskar.Job) error) (peskar.Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return peskar.Job{}, ErrJobNotFound
+	}
+	if check != nil {
+		if err := check(job); err != nil {
+			return peskar.Job{}, err
+		}
+	}
+	delete(m.jobs, id)
+	if m.journal != nil {
+		if err := m.journal.Delete(id); err != nil {
+			logrus.Error(err)
+		}
+	}
+	return job, nil
+}
+
+func (m *MemoryJobStore) Snapshot() (map[string]peskar.Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	jobs := make(map[string]peskar.Job, len(m.jobs))
+	for id, job := range m.jobs {
+		jobs[id] = job
+	}
+	return jobs, nil
+}
+
+// Compact passes a copy of the jobs to save and truncates the journal once
+// it succeeds. Mutations wait meanwhile, so none is lost between the two.
+func (m *MemoryJobStore) Compact(save func(jobs map[string]peskar.Job) error) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	jobs := make(map[string]peskar.Job, len(m.jobs))
+	for id, job := range m.jobs {
+		jobs[id] = job
+	}
+	if m.journal == nil {
+		return save(jobs)
+	}
+	return m.journal.Compact(func() error {
+		return save(jobs)
+	})
+}
+
+func (m *MemoryJobStore) Replace(jobs map[string]peskar.Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs = make(map[string]peskar.Job, len(jobs))
+	for id, job := range jobs {
+		m.jobs[id] = job
+	}
+	return nil
+}
+
+type MemoryWorkerStore struct {
+	mu      sync.RWMutex
+	workers map[string]peskar.Worker
+}
+
+func NewMemoryWorkerStore() *MemoryWorkerStore {
+	return &MemoryWorkerStore{
+		workers: make(map[string]peskar.Worker),
+	}
+}
+
+func (m *MemoryWorkerStore) Get(id string) (peskar.Worker, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	worker, ok := m.workers[id]
+	if !ok {
+		return peskar.Worker{}, ErrWorkerNotFound
+	}
+	return worker, nil
+}
+
+func (m *MemoryWorkerStore) List() ([]peskar.Worker, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	workerList := make([]peskar.Worker, 0, len(m.workers))
+	for _, worker := range m.workers {
+		workerList = append(workerList, worker)
+	}
+	return workerList, nil
+}
+
+func (m *MemoryWorkerStore) Update(id string, fn func(worker *peskar.Worker) error) (peskar.Worker, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	worker, ok := m.workers[id]
+	if !ok {
+		return peskar.Worker{}, ErrWorkerNotFound
+	}
+	if err := fn(&worker); err != nil {
+		return peskar.Worker{}, err
+	}
+	m.workers[id] = worker
+	return worker, nil
+}
+
+func (m *MemoryWorkerStore) Upsert(id string, fn func(worker *peskar.Worker) error) (peskar.Worker, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	worker := m.workers[id]
+	if err := fn(&worker); err != nil {
+		return peskar.Worker{}, err
+	}
+	m.workers[id] = worker
+	return worker, nil
+}
+
+func (m *MemoryWorkerStore) UpdateAll(fn func(worker *peskar.Worker) bool) ([]peskar.Worker, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var updated []peskar.Worker
+	for id, worker := range m.workers {
+		if fn(&worker) {
+			m.workers[id] = worker
+			updated = append(updated, worker)
+		}
+	}
+	return updated, nil
+}
+
+func (m *MemoryWorkerStore) Snapshot() (map[string]peskar.Worker, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	workers := make(map[string]peskar.Worker, len(m.workers))
+	for id, worker := range m.workers {
+		workers[id] = worker
+	}
+	return workers, nil
+}
+
+func (m *MemoryWorkerStore) Replace(workers map[string]peskar.Worker) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.workers = make(map[string]peskar.Worker, len(workers))
+	for id, worker := range workers {
+		m.workers[id] = worker
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package peskar
+
+import "time"
+
+// EventVersion is bumped on incompatible changes of the Event layout.
+const EventVersion = 1
+
+const (
+	EventJobCreated = "job.created"
+	EventJobUpdated = "job.updated"
+	EventJobDeleted = "job.deleted"
+
+	InitiatorUser   = "user"
+	InitiatorWorker = "worker"
+	InitiatorSystem = "system"
+)
+
+// Event is published to JobEventsChannel on every job change.
+// PreviousState equals the job state when the state did not change.
+type Event struct {
+	Version       int       `json:"version"`
+	Type          string    `json:"type"`
+	Job           Job       `json:"job"`
+	PreviousState State     `json:"previous_state,omitempty"`
+	Initiator     string    `json:"initiator"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func NewEvent(eventType string, job Job, previous State, initiator string) Event {
+	return Event{
+		Version:       EventVersion,
+		Type:          eventType,
+		Job:           job,
+		PreviousState: previous,
+		Initiator:     initiator,
+		CreatedAt:     time.Now().UTC(),
+	}
+}
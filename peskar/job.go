@@ -8,15 +8,27 @@ import (
 
 type Job struct {
 	ID          string `json:"id,omitempty"`
-	State       string `json:"state,omitempty"`
+	State       State  `json:"state,omitempty"`
 	DownloadURL string `json:"download_url,omitempty"`
 	InfoURL     string `json:"info_url,omitempty"`
 	Name        string `json:"name,omitempty"`
 	Description string `json:"description,omitempty"`
+	Priority    int    `json:"priority"`
+	Urgent      bool   `json:"urgent,omitempty"`
+	WorkerID    string `json:"worker_id,omitempty"`
+	Revision    int64  `json:"revision"`
 
-	AddedAt    time.Time `json:"added_at,omitempty"`
-	StartedAt  time.Time `json:"started_at,omitempty"`
-	FinishedAt time.Time `json:"finished_at,omitempty"`
+	MaxAttempts int       `json:"max_attempts,omitempty"`
+	Backoff     string    `json:"backoff,omitempty"`
+	Attempt     int       `json:"attempt,omitempty"`
+	RetryAt     time.Time `json:"retry_at,omitempty"`
+
+	AddedAt        time.Time `json:"added_at,omitempty"`
+	StartedAt      time.Time `json:"started_at,omitempty"`
+	FinishedAt     time.Time `json:"finished_at,omitempty"`
+	LeaseExpiresAt time.Time `json:"lease_expires_at,omitempty"`
+
+	Progress *Progress `json:"progress,omitempty"`
 
 	stateHistory []StateHistoryItem `json:"-"`
 	log          []LogItem          `json:"-"`
@@ -24,6 +36,14 @@ type Job struct {
 	requestedAt  time.Time          `json:"-"`
 }
 
+type JobRecord struct {
+	Job
+	StateHistory []StateHistoryItem `json:"state_history,omitempty"`
+	Log          []LogItem          `json:"log,omitempty"`
+	UpdatedAt    time.Time          `json:"updated_at,omitempty"`
+	RequestedAt  time.Time          `json:"requested_at,omitempty"`
+}
+
 type LogItem struct {
 	Initiator string    `json:"initiator"`
 	AddedAt   time.Time `json:"added_at"`
@@ -34,62 +54,159 @@ type LogItem struct {
 type StateHistoryItem struct {
 	Initiator string    `json:"initiator"`
 	ChangedAt time.Time `json:"changed_at"`
-	FromState string    `json:"from_state"`
-	ToState   string    `json:"to_state"`
+	FromState State     `json:"from_state"`
+	ToState   State     `json:"to_state"`
+	Attempt   int       `json:"attempt,omitempty"`
 }
 
-func (j *Job) SetState(initiator, state string) error {
+func (j *Job) SetState(initiator string, state State) error {
+	if !j.State.CanTransition(state) {
+		return &TransitionError{
+			From:    j.State,
+			To:      state,
+			Allowed: j.State.NextStates(),
+		}
+	}
 	h := StateHistoryItem{
 		ChangedAt: time.Now().UTC(),
 		Initiator: initiator,
 		FromState: j.State,
 		ToState:   state,
+		Attempt:   j.Attempt,
 	}
 	j.State = state
+	if state == StatePending {
+		j.WorkerID = ""
+		j.Progress = nil
+	}
+	if state != StateRequested && state != StateWorking {
+		j.LeaseExpiresAt = time.Time{}
+	}
 	j.stateHistory = append(j.stateHistory, h)
 	return nil
 }
 
-func (j *Job) SetStateUser(state string) error {
+func (j *Job) SetStateUser(state State) error {
+	if state.IsSystem() || !j.State.CanTransition(state) {
+		return &TransitionError{
+			From:    j.State,
+			To:      state,
+			Allowed: j.State.NextUserStates(),
+		}
+	}
 	return j.SetState("user", state)
 }
 
-func (j *Job) SetStateSystem(state string) error {
+func (j *Job) SetStateSystem(state State) error {
 	return j.SetState("system", state)
 }
 
 func (j *Job) IsAvailable() bool {
-	if j.State == "pending" {
+	if j.State == StatePending && !time.Now().Before(j.RetryAt) {
 		return true
 	}
 	return false
 }
 
 func (j *Job) IsDone() bool {
-	if j.State == "failed" || j.State == "finished" || j.State == "canceled" {
+	if j.State == StateFailed || j.State == StateFinished || j.State == StateCanceled || j.State == StateDeleted {
 		return true
 	}
 	return false
 }
 
+// IsActive reports whether a worker holds the job. Pending jobs waiting
+// for a retry are not active, they are skipped by IsAvailable.
 func (j *Job) IsActive() bool {
-	if j.State == "working" || j.State == "requested" || (!j.IsAvailable() && !j.IsDone()) {
+	if j.State == StateWorking || j.State == StateRequested {
 		return true
 	}
 	return false
 }
 
+func (j *Job) RetryPolicy(defaults RetryPolicy) RetryPolicy {
+	policy := defaults
+	if j.MaxAttempts > 0 {
+		policy.MaxAttempts = j.MaxAttempts
+	}
+	if j.Backoff != "" {
+		policy.Backoff = j.Backoff
+	}
+	return policy
+}
+
+// Retry puts a failed job back to the queue unless its attempts are
+// exhausted, in which case it stays failed.
+func (j *Job) Retry(defaults RetryPolicy) bool {
+	if j.State != StateFailed {
+		return false
+	}
+	policy := j.RetryPolicy(defaults)
+	if j.Attempt >= policy.MaxAttempts {
+		return false
+	}
+	j.RetryAt = time.Now().UTC().Add(policy.Next(j.Attempt))
+	j.FinishedAt = time.Time{}
+	j.SetStateSystem(StatePending)
+	return true
+}
+
+func (j *Job) IsHeldBy(workerID string) bool {
+	return (j.State == StateRequested || j.State == StateWorking) && j.WorkerID == workerID
+}
+
+// Lease gives the worker holding the job d more time to report back.
+// Zero d means the lease never expires.
+func (j *Job) Lease(d time.Duration) {
+	if d <= 0 {
+		j.LeaseExpiresAt = time.Time{}
+		return
+	}
+	j.LeaseExpiresAt = time.Now().UTC().Add(d)
+}
+
+// ExtendLease renews the lease of a working job like Lease, but only once
+// less than half of d is left, so frequent log lines do not change the job
+// every time.
+func (j *Job) ExtendLease(d time.Duration) bool {
+	if j.State != StateWorking || d <= 0 {
+		return false
+	}
+	if !j.LeaseExpiresAt.IsZero() && time.Until(j.LeaseExpiresAt) > d/2 {
+		return false
+	}
+	j.Lease(d)
+	return true
+}
+
+// RestoreLease gives a working job saved while leases were disabled a
+// lease counted from its last state change, the switch to working.
+func (j *Job) RestoreLease(d time.Duration) bool {
+	if j.State != StateWorking || !j.LeaseExpiresAt.IsZero() || d <= 0 {
+		return false
+	}
+	since := j.StartedAt
+	if since.IsZero() {
+		since = time.Now().UTC()
+	}
+	j.LeaseExpiresAt = since.Add(d)
+	return true
+}
+
 func (j *Job) IsZombie() bool {
-	if j.State == "requested" && time.Since(j.requestedAt) > 5*time.Minute {
+	if j.State != StateRequested && j.State != StateWorking {
+		return false
+	}
+	if !j.LeaseExpiresAt.IsZero() && time.Now().After(j.LeaseExpiresAt) {
 		return true
 	}
-
 	return false
 }
 
-func (j *Job) AddLogItem(log LogItem) {
+func (j *Job) AddLogItem(log LogItem) LogItem {
 	log.AddedAt = time.Now().UTC()
 	j.log = append(j.log, log)
+	return log
 }
 
 func (j *Job) Log(initiator, message string) {
@@ -125,10 +242,53 @@ func (j *Job) StateHistoryList() []StateHistoryItem {
 	return j.stateHistory
 }
 
+// LogSince returns the log items added after old was taken. It returns
+// the whole log and false if the log was deleted in between.
+func (j *Job) LogSince(old Job) ([]LogItem, bool) {
+	n := len(old.log)
+	if n > len(j.log) || (n > 0 && j.log[n-1] != old.log[n-1]) {
+		return j.log, false
+	}
+	return j.log[n:], true
+}
+
+// StateHistorySince is LogSince for the state history.
+func (j *Job) StateHistorySince(old Job) ([]StateHistoryItem, bool) {
+	n := len(old.stateHistory)
+	if n > len(j.stateHistory) || (n > 0 && j.stateHistory[n-1] != old.stateHistory[n-1]) {
+		return j.stateHistory, false
+	}
+	return j.stateHistory[n:], true
+}
+
 func (j *Job) Requested() {
 	j.requestedAt = time.Now()
+	j.RetryAt = time.Time{}
 }
 
 func (j *Job) Added() {
 	j.AddedAt = time.Now().UTC()
 }
+
+func (j *Job) Record() JobRecord {
+	return JobRecord{
+		Job:          *j,
+		StateHistory: j.stateHistory,
+		Log:          j.log,
+		UpdatedAt:    j.updatedAt,
+		RequestedAt:  j.requestedAt,
+	}
+}
+
+func (r *JobRecord) Restore() Job {
+	j := r.Job
+	j.stateHistory = r.StateHistory
+	j.log = r.Log
+	j.updatedAt = r.UpdatedAt
+	j.requestedAt = r.RequestedAt
+	// Jobs requested before leases existed are re-queued right away.
+	if j.State == StateRequested && j.LeaseExpiresAt.IsZero() {
+		j.LeaseExpiresAt = r.RequestedAt
+	}
+	return j
+}
@@ -0,0 +1,61 @@
+package peskar
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExtendLease(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name     string
+		state    State
+		expires  time.Time
+		d        time.Duration
+		extended bool
+	}{
+		{"plenty of time left", StateWorking, now.Add(50 * time.Minute), time.Hour, false},
+		{"less than half left", StateWorking, now.Add(20 * time.Minute), time.Hour, true},
+		{"no lease yet", StateWorking, time.Time{}, time.Hour, true},
+		{"leases disabled", StateWorking, time.Time{}, 0, false},
+		{"requested", StateRequested, now.Add(time.Minute), time.Hour, false},
+	}
+	for _, tt := range tests {
+		j := Job{State: tt.state, LeaseExpiresAt: tt.expires}
+		if got := j.ExtendLease(tt.d); got != tt.extended {
+			t.Errorf("%s: ExtendLease = %v, want %v", tt.name, got, tt.extended)
+		}
+		if tt.extended && j.LeaseExpiresAt.Before(now.Add(tt.d)) {
+			t.Errorf("%s: lease expires at %v", tt.name, j.LeaseExpiresAt)
+		}
+		if !tt.extended && !j.LeaseExpiresAt.Equal(tt.expires) {
+			t.Errorf("%s: lease changed to %v", tt.name, j.LeaseExpiresAt)
+		}
+	}
+}
+
+func TestRestoreLease(t *testing.T) {
+	started := time.Date(2026, 10, 12, 3, 0, 0, 0, time.UTC)
+	leased := started.Add(time.Minute)
+	tests := []struct {
+		name    string
+		job     Job
+		d       time.Duration
+		expires time.Time
+	}{
+		{"working without a lease", Job{State: StateWorking, StartedAt: started}, time.Hour, started.Add(time.Hour)},
+		{"leases disabled", Job{State: StateWorking, StartedAt: started}, 0, time.Time{}},
+		{"working with a lease", Job{State: StateWorking, StartedAt: started, LeaseExpiresAt: leased}, time.Hour, leased},
+		{"finished", Job{State: StateFinished, StartedAt: started}, time.Hour, time.Time{}},
+	}
+	for _, tt := range tests {
+		j := tt.job
+		restored := j.RestoreLease(tt.d)
+		if restored != !tt.expires.Equal(tt.job.LeaseExpiresAt) {
+			t.Errorf("%s: RestoreLease = %v", tt.name, restored)
+		}
+		if !j.LeaseExpiresAt.Equal(tt.expires) {
+			t.Errorf("%s: lease expires at %v, want %v", tt.name, j.LeaseExpiresAt, tt.expires)
+		}
+	}
+}
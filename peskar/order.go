@@ -0,0 +1,41 @@
+package peskar
+
+import (
+	"sort"
+	"time"
+)
+
+// ByQueueOrder sorts jobs in the order workers receive them: jobs
+// waiting for a retry at Now go last, the rest by priority and then FIFO.
+type ByQueueOrder struct {
+	Jobs []Job
+	Now  time.Time
+}
+
+// QueueOrder sorts the jobs in place in the queue order at this moment.
+func QueueOrder(jobs []Job) {
+	sort.Sort(ByQueueOrder{jobs, time.Now()})
+}
+
+func (a ByQueueOrder) Len() int      { return len(a.Jobs) }
+func (a ByQueueOrder) Swap(i, j int) { a.Jobs[i], a.Jobs[j] = a.Jobs[j], a.Jobs[i] }
+func (a ByQueueOrder) Less(i, j int) bool {
+	return a.Jobs[i].QueueBefore(&a.Jobs[j], a.Now)
+}
+
+func (j *Job) QueueBefore(o *Job, now time.Time) bool {
+	jWaiting, oWaiting := now.Before(j.RetryAt), now.Before(o.RetryAt)
+	if jWaiting != oWaiting {
+		return oWaiting
+	}
+	if jWaiting && !j.RetryAt.Equal(o.RetryAt) {
+		return j.RetryAt.Before(o.RetryAt)
+	}
+	if j.Priority != o.Priority {
+		return j.Priority > o.Priority
+	}
+	if !j.AddedAt.Equal(o.AddedAt) {
+		return j.AddedAt.Before(o.AddedAt)
+	}
+	return j.ID < o.ID
+}
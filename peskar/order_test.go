@@ -0,0 +1,26 @@
+package peskar
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestQueueOrder(t *testing.T) {
+	now := time.Now()
+	jobs := []Job{
+		{ID: "retry-later", RetryAt: now.Add(2 * time.Hour), Priority: 10},
+		{ID: "retry-sooner", RetryAt: now.Add(time.Hour)},
+		{ID: "old", AddedAt: now.Add(-2 * time.Hour)},
+		{ID: "new", AddedAt: now.Add(-time.Hour)},
+		{ID: "urgent", AddedAt: now, Priority: 5},
+		{ID: "retry-due", RetryAt: now.Add(-time.Minute), AddedAt: now.Add(-3 * time.Hour)},
+	}
+	sort.Sort(ByQueueOrder{jobs, now})
+	want := []string{"urgent", "retry-due", "old", "new", "retry-sooner", "retry-later"}
+	for i, id := range want {
+		if jobs[i].ID != id {
+			t.Fatalf("position %d is '%s', want '%s'", i, jobs[i].ID, id)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package peskar
+
+import (
+	"errors"
+	"time"
+)
+
+// Progress is the last progress report of a worker. Speed is in bytes
+// per second and ETA in seconds.
+type Progress struct {
+	JobID      string    `json:"job_id,omitempty"`
+	Phase      string    `json:"phase,omitempty"`
+	BytesDone  int64     `json:"bytes_done"`
+	BytesTotal int64     `json:"bytes_total,omitempty"`
+	Speed      int64     `json:"speed,omitempty"`
+	ETA        int64     `json:"eta,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at,omitempty"`
+}
+
+func (p Progress) Validate() error {
+	if p.BytesDone < 0 || p.BytesTotal < 0 || p.Speed < 0 || p.ETA < 0 {
+		return errors.New("Progress values cant be negative")
+	}
+	if p.BytesTotal > 0 && p.BytesDone > p.BytesTotal {
+		return errors.New("Bytes done cant exceed bytes total")
+	}
+	return nil
+}
+
+func (j *Job) SetProgress(p Progress) {
+	p.JobID = ""
+	p.UpdatedAt = time.Now().UTC()
+	j.Progress = &p
+}
@@ -1,6 +1,7 @@
 package peskar
 
 const (
-	JobEventsChannel = "job.events"
-	JobLogChannel    = "job.logs"
+	JobEventsChannel   = "job.events"
+	JobLogChannel      = "job.logs"
+	JobProgressChannel = "job.progress"
 )
@@ -0,0 +1,63 @@
+package peskar
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	BackoffFixed       = "fixed"
+	BackoffExponential = "exponential"
+
+	// maxBackoff bounds the delay without MaxDelay, so that neither
+	// doubling nor jitter overflows.
+	maxBackoff = time.Duration(math.MaxInt64 / 2)
+)
+
+type RetryPolicy struct {
+	MaxAttempts int
+	Backoff     string
+	Delay       time.Duration
+	MaxDelay    time.Duration
+	Jitter      float64
+}
+
+func (p RetryPolicy) Validate() error {
+	if p.MaxAttempts < 1 {
+		return fmt.Errorf("Max attempts must be at least 1, got %d", p.MaxAttempts)
+	}
+	if p.Backoff != BackoffFixed && p.Backoff != BackoffExponential {
+		return fmt.Errorf("Unknown backoff '%s', must be '%s' or '%s'", p.Backoff, BackoffFixed, BackoffExponential)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("Jitter must be between 0 and 1, got %v", p.Jitter)
+	}
+	return nil
+}
+
+// Next returns the delay before the attempt following the given one.
+func (p RetryPolicy) Next(attempt int) time.Duration {
+	limit := p.MaxDelay
+	if limit <= 0 || limit > maxBackoff {
+		limit = maxBackoff
+	}
+	d := p.Delay
+	if p.Backoff == BackoffExponential {
+		for i := 1; i < attempt && d > 0 && d < limit; i++ {
+			if d > limit/2 {
+				d = limit
+				break
+			}
+			d *= 2
+		}
+	}
+	if d > limit {
+		d = limit
+	}
+	if p.Jitter > 0 && d > 0 {
+		d += time.Duration(rand.Int63n(int64(float64(d)*p.Jitter) + 1))
+	}
+	return d
+}
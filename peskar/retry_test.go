@@ -0,0 +1,118 @@
+package peskar
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyNext(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{"fixed first", RetryPolicy{Backoff: BackoffFixed, Delay: time.Minute}, 1, time.Minute},
+		{"fixed later", RetryPolicy{Backoff: BackoffFixed, Delay: time.Minute}, 5, time.Minute},
+		{"fixed capped", RetryPolicy{Backoff: BackoffFixed, Delay: time.Hour, MaxDelay: time.Minute}, 1, time.Minute},
+		{"exponential first", RetryPolicy{Backoff: BackoffExponential, Delay: time.Minute}, 1, time.Minute},
+		{"exponential second", RetryPolicy{Backoff: BackoffExponential, Delay: time.Minute}, 2, 2 * time.Minute},
+		{"exponential fourth", RetryPolicy{Backoff: BackoffExponential, Delay: time.Minute}, 4, 8 * time.Minute},
+		{"exponential capped", RetryPolicy{Backoff: BackoffExponential, Delay: time.Minute, MaxDelay: 5 * time.Minute}, 4, 5 * time.Minute},
+		{"exponential many attempts", RetryPolicy{Backoff: BackoffExponential, Delay: time.Minute, MaxDelay: time.Hour}, 1000, time.Hour},
+		{"no delay", RetryPolicy{Backoff: BackoffExponential}, 3, 0},
+		{"many attempts without max delay", RetryPolicy{Backoff: BackoffExponential, Delay: time.Minute}, 1000, maxBackoff},
+		{"overflowing shift without max delay", RetryPolicy{Backoff: BackoffExponential, Delay: time.Second}, 64, maxBackoff},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.Next(tt.attempt); got != tt.want {
+			t.Errorf("%s: Next(%d) = %v, want %v", tt.name, tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyJitter(t *testing.T) {
+	policy := RetryPolicy{Backoff: BackoffExponential, Delay: time.Minute, Jitter: 0.5}
+	for attempt := 1; attempt <= 3; attempt++ {
+		base := time.Minute << uint(attempt-1)
+		for i := 0; i < 100; i++ {
+			got := policy.Next(attempt)
+			if got < base || got > base+base/2 {
+				t.Fatalf("Next(%d) = %v, want between %v and %v", attempt, got, base, base+base/2)
+			}
+		}
+	}
+}
+
+func TestRetryPolicyJitterLarge(t *testing.T) {
+	policy := RetryPolicy{Backoff: BackoffExponential, Delay: time.Minute, Jitter: 1}
+	for i := 0; i < 100; i++ {
+		if got := policy.Next(1000); got < maxBackoff {
+			t.Fatalf("Next(1000) = %v, want at least %v", got, maxBackoff)
+		}
+	}
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		ok     bool
+	}{
+		{"fixed", RetryPolicy{MaxAttempts: 1, Backoff: BackoffFixed}, true},
+		{"exponential with jitter", RetryPolicy{MaxAttempts: 3, Backoff: BackoffExponential, Jitter: 1}, true},
+		{"no attempts", RetryPolicy{Backoff: BackoffFixed}, false},
+		{"unknown backoff", RetryPolicy{MaxAttempts: 1, Backoff: "linear"}, false},
+		{"negative jitter", RetryPolicy{MaxAttempts: 1, Backoff: BackoffFixed, Jitter: -0.1}, false},
+		{"large jitter", RetryPolicy{MaxAttempts: 1, Backoff: BackoffFixed, Jitter: 1.5}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.policy.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v", tt.name, err)
+		}
+	}
+}
+
+func TestJobRetry(t *testing.T) {
+	defaults := RetryPolicy{MaxAttempts: 3, Backoff: BackoffFixed, Delay: time.Minute}
+	tests := []struct {
+		name  string
+		job   Job
+		retry bool
+	}{
+		{"first attempt failed", Job{State: StateFailed, Attempt: 1}, true},
+		{"last attempt failed", Job{State: StateFailed, Attempt: 3}, false},
+		{"job limit", Job{State: StateFailed, Attempt: 1, MaxAttempts: 1}, false},
+		{"job allows more", Job{State: StateFailed, Attempt: 3, MaxAttempts: 5}, true},
+		{"finished", Job{State: StateFinished, Attempt: 1}, false},
+		{"canceled", Job{State: StateCanceled, Attempt: 1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := tt.job
+			j.FinishedAt = time.Now()
+			before := time.Now()
+			if got := j.Retry(defaults); got != tt.retry {
+				t.Fatalf("Retry() = %v, want %v", got, tt.retry)
+			}
+			if !tt.retry {
+				if j.State != tt.job.State {
+					t.Errorf("state = '%s', want '%s'", j.State, tt.job.State)
+				}
+				return
+			}
+			if j.State != StatePending || !j.FinishedAt.IsZero() {
+				t.Errorf("job not re-queued: %+v", j)
+			}
+			if j.RetryAt.Before(before.Add(time.Minute)) {
+				t.Errorf("retry at %v, want a minute after %v", j.RetryAt, before)
+			}
+			if j.IsAvailable() {
+				t.Error("job in backoff is available")
+			}
+			if j.IsActive() {
+				t.Error("job in backoff is active")
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package peskar
+
+import (
+	"fmt"
+	"strings"
+)
+
+type State string
+
+const (
+	StatePending   State = "pending"
+	StateRequested State = "requested"
+	StateWorking   State = "working"
+	StateCanceled  State = "canceled"
+	StateFinished  State = "finished"
+	StateFailed    State = "failed"
+	StateDeleted   State = "deleted"
+)
+
+var (
+	transitions = map[State][]State{
+		"":             {StatePending},
+		StatePending:   {StateRequested, StateCanceled, StateDeleted},
+		StateRequested: {StatePending, StateWorking, StateCanceled, StateFailed},
+		StateWorking:   {StatePending, StateFinished, StateCanceled, StateFailed},
+		StateCanceled:  {StatePending, StateDeleted},
+		StateFinished:  {StatePending, StateDeleted},
+		StateFailed:    {StatePending, StateDeleted},
+		StateDeleted:   {},
+	}
+
+	// States only the hub itself may switch a job to: requested is set
+	// on dispatch and deleted on DELETE /job/{id}/.
+	systemStates = map[State]bool{
+		StateRequested: true,
+		StateDeleted:   true,
+	}
+
+	// States a worker reports for the job it holds.
+	workerStates = map[State]bool{
+		StateWorking:  true,
+		StateFinished: true,
+		StateFailed:   true,
+	}
+)
+
+type TransitionError struct {
+	From    State
+	To      State
+	Allowed []State
+}
+
+func (e *TransitionError) Error() string {
+	if !e.To.IsValid() {
+		return fmt.Sprintf("Unknown state '%s', allowed: %s", e.To, joinStates(e.Allowed))
+	}
+	return fmt.Sprintf("Cant change state from '%s' to '%s', allowed: %s", e.From, e.To, joinStates(e.Allowed))
+}
+
+func joinStates(states []State) string {
+	if len(states) == 0 {
+		return "none"
+	}
+	s := make([]string, len(states))
+	for i, state := range states {
+		s[i] = string(state)
+	}
+	return strings.Join(s, ", ")
+}
+
+func (s State) IsValid() bool {
+	if s == "" {
+		return false
+	}
+	_, ok := transitions[s]
+	return ok
+}
+
+func (s State) IsSystem() bool {
+	return systemStates[s]
+}
+
+func (s State) IsWorker() bool {
+	return workerStates[s]
+}
+
+func (s State) NextStates() []State {
+	return transitions[s]
+}
+
+func (s State) NextUserStates() []State {
+	var states []State
+	for _, state := range transitions[s] {
+		if !state.IsSystem() {
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+func (s State) CanTransition(to State) bool {
+	for _, state := range transitions[s] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
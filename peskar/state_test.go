@@ -0,0 +1,156 @@
+package peskar
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from State
+		to   State
+		want bool
+	}{
+		{"", StatePending, true},
+		{"", StateWorking, false},
+		{StatePending, StateRequested, true},
+		{StatePending, StateWorking, false},
+		{StatePending, StateFinished, false},
+		{StatePending, StateCanceled, true},
+		{StatePending, StateDeleted, true},
+		{StateRequested, StateWorking, true},
+		{StateRequested, StatePending, true},
+		{StateRequested, StateFailed, true},
+		{StateRequested, StateFinished, false},
+		{StateWorking, StateFinished, true},
+		{StateWorking, StateFailed, true},
+		{StateWorking, StateCanceled, true},
+		{StateWorking, StateRequested, false},
+		{StateWorking, StateDeleted, false},
+		{StateFinished, StatePending, true},
+		{StateFinished, StateDeleted, true},
+		{StateFinished, StateWorking, false},
+		{StateFailed, StatePending, true},
+		{StateCanceled, StateDeleted, true},
+		{StateDeleted, StatePending, false},
+		{StatePending, "unknown", false},
+		{"unknown", StatePending, false},
+	}
+	for _, tt := range tests {
+		if got := tt.from.CanTransition(tt.to); got != tt.want {
+			t.Errorf("'%s' -> '%s' = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestNextUserStates(t *testing.T) {
+	tests := []struct {
+		from State
+		want []State
+	}{
+		{StatePending, []State{StateCanceled}},
+		{StateRequested, []State{StatePending, StateWorking, StateCanceled, StateFailed}},
+		{StateWorking, []State{StatePending, StateFinished, StateCanceled, StateFailed}},
+		{StateFinished, []State{StatePending}},
+		{StateDeleted, nil},
+	}
+	for _, tt := range tests {
+		if got := tt.from.NextUserStates(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("'%s' user states = %v, want %v", tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestSetStateUser(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    State
+		to      State
+		err     string
+		allowed []State
+	}{
+		{
+			name: "worker starts",
+			from: StateRequested,
+			to:   StateWorking,
+		},
+		{
+			name:    "requested is set by the hub",
+			from:    StatePending,
+			to:      StateRequested,
+			err:     "Cant change state from 'pending' to 'requested', allowed: canceled",
+			allowed: []State{StateCanceled},
+		},
+		{
+			name:    "deleted is set by the hub",
+			from:    StateFinished,
+			to:      StateDeleted,
+			err:     "Cant change state from 'finished' to 'deleted', allowed: pending",
+			allowed: []State{StatePending},
+		},
+		{
+			name:    "not allowed",
+			from:    StatePending,
+			to:      StateFinished,
+			err:     "Cant change state from 'pending' to 'finished', allowed: canceled",
+			allowed: []State{StateCanceled},
+		},
+		{
+			name:    "unknown state",
+			from:    StateWorking,
+			to:      "done",
+			err:     "Unknown state 'done', allowed: pending, finished, canceled, failed",
+			allowed: []State{StatePending, StateFinished, StateCanceled, StateFailed},
+		},
+		{
+			name: "nothing allowed",
+			from: StateDeleted,
+			to:   StatePending,
+			err:  "Cant change state from 'deleted' to 'pending', allowed: none",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := Job{State: tt.from}
+			err := j.SetStateUser(tt.to)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if j.State != tt.to {
+					t.Errorf("state = '%s', want '%s'", j.State, tt.to)
+				}
+				history := j.StateHistoryList()
+				if len(history) != 1 || history[0].FromState != tt.from || history[0].ToState != tt.to || history[0].Initiator != "user" {
+					t.Errorf("state history = %+v", history)
+				}
+				return
+			}
+			e, ok := err.(*TransitionError)
+			if !ok {
+				t.Fatalf("got %v, want a transition error", err)
+			}
+			if e.Error() != tt.err {
+				t.Errorf("error = %q, want %q", e.Error(), tt.err)
+			}
+			if !reflect.DeepEqual(e.Allowed, tt.allowed) {
+				t.Errorf("allowed = %v, want %v", e.Allowed, tt.allowed)
+			}
+			if j.State != tt.from || len(j.StateHistoryList()) != 0 {
+				t.Errorf("job changed by a rejected transition: %+v", j)
+			}
+		})
+	}
+}
+
+func TestSetStateClearsHolder(t *testing.T) {
+	j := Job{State: StateWorking, WorkerID: "worker", Progress: &Progress{BytesDone: 1}}
+	j.Lease(time.Minute)
+	if err := j.SetStateSystem(StatePending); err != nil {
+		t.Fatal(err)
+	}
+	if j.WorkerID != "" || j.Progress != nil || !j.LeaseExpiresAt.IsZero() {
+		t.Errorf("pending job keeps its holder: %+v", j)
+	}
+}
@@ -1,16 +1,32 @@
 package peskar
 
-import "time"
+import (
+	"time"
+
+	"github.com/paradev-ru/peskar-hub/lib"
+)
+
+const (
+	WorkerIDHeader           = "X-Peskar-Worker-Id"
+	WorkerHostnameHeader     = "X-Peskar-Worker-Hostname"
+	WorkerVersionHeader      = "X-Peskar-Worker-Version"
+	WorkerCapabilitiesHeader = "X-Peskar-Worker-Capabilities"
+)
 
 type Worker struct {
-	IP         string    `json:"ip,omitempty"`
-	State      string    `json:"state,omitempty"`
-	UserAget   string    `json:"user_agent,omitempty"`
-	LastSeenAt time.Time `json:"last_seen_at,omitempty"`
+	ID           string        `json:"id,omitempty"`
+	IP           string        `json:"ip,omitempty"`
+	Hostname     string        `json:"hostname,omitempty"`
+	Version      string        `json:"version,omitempty"`
+	Capabilities []string      `json:"capabilities,omitempty"`
+	State        string        `json:"state,omitempty"`
+	UserAget     string        `json:"user_agent,omitempty"`
+	LastSeenAt   time.Time     `json:"last_seen_at,omitempty"`
+	Schedule     *lib.Schedule `json:"schedule,omitempty"`
 }
 
-func (w *Worker) IsZombie() bool {
-	if w.IsActive() && time.Since(w.LastSeenAt) > 5*time.Minute {
+func (w *Worker) IsZombie(timeout time.Duration) bool {
+	if w.IsActive() && time.Since(w.LastSeenAt) > timeout {
 		return true
 	}
 	return false
@@ -22,3 +38,10 @@ func (w *Worker) IsActive() bool {
 	}
 	return false
 }
+
+func (w *Worker) IsAvailable(t time.Time) bool {
+	if w.Schedule == nil {
+		return true
+	}
+	return w.Schedule.IsAvailable(t)
+}
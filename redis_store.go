@@ -0,0 +1,616 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/paradev-ru/peskar-hub/lib"
+	"github.com/paradev-ru/peskar-hub/peskar"
+)
+
+const (
+	RedisKeyPrefix       = "peskar"
+	redisMaxTransactions = 32
+	redisRetryDelay      = 5 * time.Millisecond
+)
+
+var (
+	ErrStoreConflict = errors.New("Too many concurrent store updates, try again")
+)
+
+// RedisJobStore keeps jobs in the "peskar:jobs" hash and their logs and
+// state histories in per-job lists. Transactions watch per-job revision
+// keys, bumped whenever the job itself changes, and the revision of the
+// job set, bumped on adding and deleting jobs. Appending a log does not
+// change the job, so busy workers do not conflict with dispatching.
+type RedisJobStore struct {
+	redis *lib.RedisStore
+}
+
+func NewRedisJobStore(r *lib.RedisStore) *RedisJobStore {
+	return &RedisJobStore{r}
+}
+
+func redisKey(parts ...string) string {
+	key := RedisKeyPrefix
+	for _, part := range parts {
+		key += ":" + part
+	}
+	return key
+}
+
+func jobsKey() string {
+	return redisKey("jobs")
+}
+
+func jobLogKey(id string) string {
+	return redisKey("job", id, "log")
+}
+
+func jobStateHistoryKey(id string) string {
+	return redisKey("job", id, "state_history")
+}
+
+func jobRevKey(id string) string {
+	return redisKey("job", id, "rev")
+}
+
+func jobsRevKey() string {
+	return redisKey("jobs", "rev")
+}
+
+func watch(conn redis.Conn, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	_, err := conn.Do("WATCH", args...)
+	return err
+}
+
+// watchJob watches everything readJob reads.
+func watchJob(conn redis.Conn, id string) error {
+	return watch(conn, jobRevKey(id), jobLogKey(id), jobStateHistoryKey(id))
+}
+
+// watchAllJobs watches the job set and every job without their logs.
+func watchAllJobs(conn redis.Conn) error {
+	if err := watch(conn, jobsRevKey()); err != nil {
+		return err
+	}
+	ids, err := redis.Strings(conn.Do("HKEYS", jobsKey()))
+	if err != nil {
+		return err
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = jobRevKey(id)
+	}
+	return watch(conn, keys...)
+}
+
+// readJobs decodes the jobs hash entries. Logs and state histories are
+// only read with full.
+func readJobs(conn redis.Conn, raw map[string]string, full bool) (map[string]peskar.Job, error) {
+	jobs := make(map[string]peskar.Job, len(raw))
+	if !full {
+		for id, data := range raw {
+			var record peskar.JobRecord
+			if err := json.Unmarshal([]byte(data), &record); err != nil {
+				return nil, fmt.Errorf("Job '%s' unmarshal error: %v", id, err)
+			}
+			jobs[id] = record.Restore()
+		}
+		return jobs, nil
+	}
+	ids := make([]string, 0, len(raw))
+	for id := range raw {
+		ids = append(ids, id)
+		conn.Send("LRANGE", jobLogKey(id), 0, -1)
+		conn.Send("LRANGE", jobStateHistoryKey(id), 0, -1)
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		var record peskar.JobRecord
+		if err := json.Unmarshal([]byte(raw[id]), &record); err != nil {
+			return nil, fmt.Errorf("Job '%s' unmarshal error: %v", id, err)
+		}
+		logs, err := redis.ByteSlices(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		for _, data := range logs {
+			var item peskar.LogItem
+			if err := json.Unmarshal(data, &item); err != nil {
+				return nil, err
+			}
+			record.Log = append(record.Log, item)
+		}
+		history, err := redis.ByteSlices(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		for _, data := range history {
+			var item peskar.StateHistoryItem
+			if err := json.Unmarshal(data, &item); err != nil {
+				return nil, err
+			}
+			record.StateHistory = append(record.StateHistory, item)
+		}
+		jobs[id] = record.Restore()
+	}
+	return jobs, nil
+}
+
+func readAllJobs(conn redis.Conn, full bool) (map[string]peskar.Job, error) {
+	raw, err := redis.StringMap(conn.Do("HGETALL", jobsKey()))
+	if err != nil {
+		return nil, err
+	}
+	return readJobs(conn, raw, full)
+}
+
+func readJob(conn redis.Conn, id string) (peskar.Job, error) {
+	data, err := redis.String(conn.Do("HGET", jobsKey(), id))
+	if err == redis.ErrNil {
+		return peskar.Job{}, ErrJobNotFound
+	}
+	if err != nil {
+		return peskar.Job{}, err
+	}
+	jobs, err := readJobs(conn, map[string]string{id: data}, true)
+	if err != nil {
+		return peskar.Job{}, err
+	}
+	return jobs[id], nil
+}
+
+// sendJob queues the commands turning old into job. The job is written
+// only if it changed. Log and state history items are only appended,
+// unless the lists were deleted, so old may come without them.
+func sendJob(conn redis.Conn, old *peskar.Job, job *peskar.Job) error {
+	changed := true
+	if old == nil {
+		old = &peskar.Job{}
+		conn.Send("INCR", jobsRevKey())
+	} else {
+		var err error
+		if changed, err = bumpRevision(old, job); err != nil {
+			return err
+		}
+	}
+	if changed {
+		data, err := jobFields(*job)
+		if err != nil {
+			return err
+		}
+		conn.Send("HSET", jobsKey(), job.ID, data)
+		conn.Send("INCR", jobRevKey(job.ID))
+	}
+
+	log, appended := job.LogSince(*old)
+	if !appended {
+		conn.Send("DEL", jobLogKey(job.ID))
+	}
+	for _, item := range log {
+		data, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		conn.Send("RPUSH", jobLogKey(job.ID), data)
+	}
+	history, appended := job.StateHistorySince(*old)
+	if !appended {
+		conn.Send("DEL", jobStateHistoryKey(job.ID))
+	}
+	for _, item := range history {
+		data, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		conn.Send("RPUSH", jobStateHistoryKey(job.ID), data)
+	}
+	return nil
+}
+
+func sendDeleteJob(conn redis.Conn, id string) {
+	conn.Send("HDEL", jobsKey(), id)
+	conn.Send("DEL", jobLogKey(id), jobStateHistoryKey(id), jobRevKey(id))
+	conn.Send("INCR", jobsRevKey())
+}
+
+// transaction runs fn against a connection and retries when a key fn
+// watched was modified by someone else before EXEC.
+func transaction(r *lib.RedisStore, fn func(conn redis.Conn) error) error {
+	conn := r.Conn()
+	defer conn.Close()
+	for i := 0; i < redisMaxTransactions; i++ {
+		var committed bool
+		err := fn(conn)
+		if err == nil {
+			var reply interface{}
+			reply, err = conn.Do("EXEC")
+			committed = reply != nil
+		} else {
+			conn.Do("DISCARD")
+		}
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		if committed {
+			return nil
+		}
+		time.Sleep(time.Duration(rand.Int63n(int64(i+1) * int64(redisRetryDelay))))
+	}
+	return ErrStoreConflict
+}
+
+func (m *RedisJobStore) Get(id string) (peskar.Job, error) {
+	conn := m.redis.Conn()
+	defer conn.Close()
+	return readJob(conn, id)
+}
+
+func (m *RedisJobStore) List() ([]peskar.Job, error) {
+	conn := m.redis.Conn()
+	defer conn.Close()
+	jobs, err := readAllJobs(conn, false)
+	if err != nil {
+		return nil, err
+	}
+	jobList := make([]peskar.Job, 0, len(jobs))
+	for _, job := range jobs {
+		jobList = append(jobList, job)
+	}
+	return jobList, nil
+}
+
+func (m *RedisJobStore) Add(job peskar.Job, check func(existing peskar.Job) error) error {
+	return transaction(m.redis, func(conn redis.Conn) error {
+		if check == nil {
+			if err := watch(conn, jobsRevKey()); err != nil {
+				return err
+			}
+		} else {
+			if err := watchAllJobs(conn); err != nil {
+				return err
+			}
+			jobs, err := readAllJobs(conn, false)
+			if err != nil {
+				return err
+			}
+			for _, existing := range jobs {
+				if err := check(existing); err != nil {
+					return err
+				}
+			}
+		}
+		conn.Send("MULTI")
+		return sendJob(conn, nil, &job)
+	})
+}
+
+func (m *RedisJobStore) Update(id string, fn func(job *peskar.Job) error) (peskar.Job, error) {
+	var job peskar.Job
+	err := transaction(m.redis, func(conn redis.Conn) error {
+		if err := watchJob(conn, id); err != nil {
+			return err
+		}
+		old, err := readJob(conn, id)
+		if err != nil {
+			return err
+		}
+		job = old
+		if err := fn(&job); err != nil {
+			return err
+		}
+		conn.Send("MULTI")
+		return sendJob(conn, &old, &job)
+	})
+	if err != nil {
+		return peskar.Job{}, err
+	}
+	return job, nil
+}
+
+func (m *RedisJobStore) UpdateFirst(check func(jobs []peskar.Job) error, fn func(job *peskar.Job) bool) (*peskar.Job, error) {
+	var found *peskar.Job
+	err := transaction(m.redis, func(conn redis.Conn) error {
+		found = nil
+		if err := watchAllJobs(conn); err != nil {
+			return err
+		}
+		jobs, err := readAllJobs(conn, false)
+		if err != nil {
+			return err
+		}
+		jobList := make([]peskar.Job, 0, len(jobs))
+		for _, job := range jobs {
+			jobList = append(jobList, job)
+		}
+		if check != nil {
+			if err := check(jobList); err != nil {
+				return err
+			}
+		}
+		peskar.QueueOrder(jobList)
+		conn.Send("MULTI")
+		for _, old := range jobList {
+			job := old
+			if fn(&job) {
+				found = &job
+				return sendJob(conn, &old, &job)
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+func (m *RedisJobStore) UpdateAll(fn func(job *peskar.Job) bool) ([]peskar.Job, error) {
+	var updated []peskar.Job
+	err := transaction(m.redis, func(conn redis.Conn) error {
+		updated = nil
+		if err := watchAllJobs(conn); err != nil {
+			return err
+		}
+		jobs, err := readAllJobs(conn, false)
+		if err != nil {
+			return err
+		}
+		conn.Send("MULTI")
+		for _, old := range jobs {
+			job := old
+			if !fn(&job) {
+				continue
+			}
+			if err := sendJob(conn, &old, &job); err != nil {
+				return err
+			}
+			updated = append(updated, job)
+		}
+		return nil
+	})
+	return updated, err
+}
+
+func (m *RedisJobStore) Delete(id string, check func(job peskar.Job) error) (peskar.Job, error) {
+	var job peskar.Job
+	err := transaction(m.redis, func(conn redis.Conn) error {
+		if err := watchJob(conn, id); err != nil {
+			return err
+		}
+		var err error
+		job, err = readJob(conn, id)
+		if err != nil {
+			return err
+		}
+		if check != nil {
+			if err := check(job); err != nil {
+				return err
+			}
+		}
+		conn.Send("MULTI")
+		sendDeleteJob(conn, id)
+		return nil
+	})
+	if err != nil {
+		return peskar.Job{}, err
+	}
+	return job, nil
+}
+
+func (m *RedisJobStore) Snapshot() (map[string]peskar.Job, error) {
+	conn := m.redis.Conn()
+	defer conn.Close()
+	return readAllJobs(conn, true)
+}
+
+func (m *RedisJobStore) Replace(jobs map[string]peskar.Job) error {
+	return transaction(m.redis, func(conn redis.Conn) error {
+		if err := watchAllJobs(conn); err != nil {
+			return err
+		}
+		ids, err := redis.Strings(conn.Do("HKEYS", jobsKey()))
+		if err != nil {
+			return err
+		}
+		conn.Send("MULTI")
+		for _, id := range ids {
+			sendDeleteJob(conn, id)
+		}
+		for _, job := range jobs {
+			if err := sendJob(conn, nil, &job); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RedisWorkerStore keeps workers in the "peskar:workers" hash. Updates of
+// a single worker watch its revision key, so pings of different workers
+// do not conflict.
+type RedisWorkerStore struct {
+	redis *lib.RedisStore
+}
+
+func NewRedisWorkerStore(r *lib.RedisStore) *RedisWorkerStore {
+	return &RedisWorkerStore{r}
+}
+
+func workersKey() string {
+	return redisKey("workers")
+}
+
+func workerRevKey(id string) string {
+	return redisKey("worker", id, "rev")
+}
+
+func readAllWorkers(conn redis.Conn) (map[string]peskar.Worker, error) {
+	raw, err := redis.StringMap(conn.Do("HGETALL", workersKey()))
+	if err != nil {
+		return nil, err
+	}
+	workers := make(map[string]peskar.Worker, len(raw))
+	for id, data := range raw {
+		var worker peskar.Worker
+		if err := json.Unmarshal([]byte(data), &worker); err != nil {
+			return nil, fmt.Errorf("Worker '%s' unmarshal error: %v", id, err)
+		}
+		if worker.ID == "" {
+			worker.ID = id
+		}
+		workers[id] = worker
+	}
+	return workers, nil
+}
+
+func sendWorker(conn redis.Conn, id string, worker peskar.Worker) error {
+	data, err := json.Marshal(worker)
+	if err != nil {
+		return err
+	}
+	if err := conn.Send("HSET", workersKey(), id, data); err != nil {
+		return err
+	}
+	return conn.Send("INCR", workerRevKey(id))
+}
+
+func readWorker(conn redis.Conn, id string) (peskar.Worker, error) {
+	data, err := redis.Bytes(conn.Do("HGET", workersKey(), id))
+	if err == redis.ErrNil {
+		return peskar.Worker{}, ErrWorkerNotFound
+	}
+	if err != nil {
+		return peskar.Worker{}, err
+	}
+	var worker peskar.Worker
+	if err := json.Unmarshal(data, &worker); err != nil {
+		return peskar.Worker{}, err
+	}
+	if worker.ID == "" {
+		worker.ID = id
+	}
+	return worker, nil
+}
+
+func (m *RedisWorkerStore) Get(id string) (peskar.Worker, error) {
+	conn := m.redis.Conn()
+	defer conn.Close()
+	return readWorker(conn, id)
+}
+
+func (m *RedisWorkerStore) List() ([]peskar.Worker, error) {
+	conn := m.redis.Conn()
+	defer conn.Close()
+	workers, err := readAllWorkers(conn)
+	if err != nil {
+		return nil, err
+	}
+	workerList := make([]peskar.Worker, 0, len(workers))
+	for _, worker := range workers {
+		workerList = append(workerList, worker)
+	}
+	return workerList, nil
+}
+
+func (m *RedisWorkerStore) update(id string, create bool, fn func(worker *peskar.Worker) error) (peskar.Worker, error) {
+	var worker peskar.Worker
+	err := transaction(m.redis, func(conn redis.Conn) error {
+		if err := watch(conn, workerRevKey(id)); err != nil {
+			return err
+		}
+		var err error
+		worker, err = readWorker(conn, id)
+		if err == ErrWorkerNotFound && create {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(&worker); err != nil {
+			return err
+		}
+		conn.Send("MULTI")
+		return sendWorker(conn, id, worker)
+	})
+	if err != nil {
+		return peskar.Worker{}, err
+	}
+	return worker, nil
+}
+
+func (m *RedisWorkerStore) Update(id string, fn func(worker *peskar.Worker) error) (peskar.Worker, error) {
+	return m.update(id, false, fn)
+}
+
+func (m *RedisWorkerStore) Upsert(id string, fn func(worker *peskar.Worker) error) (peskar.Worker, error) {
+	return m.update(id, true, fn)
+}
+
+func (m *RedisWorkerStore) UpdateAll(fn func(worker *peskar.Worker) bool) ([]peskar.Worker, error) {
+	var updated []peskar.Worker
+	err := transaction(m.redis, func(conn redis.Conn) error {
+		if err := watch(conn, workersKey()); err != nil {
+			return err
+		}
+		updated = nil
+		workers, err := readAllWorkers(conn)
+		if err != nil {
+			return err
+		}
+		conn.Send("MULTI")
+		for id, worker := range workers {
+			if !fn(&worker) {
+				continue
+			}
+			if err := sendWorker(conn, id, worker); err != nil {
+				return err
+			}
+			updated = append(updated, worker)
+		}
+		return nil
+	})
+	return updated, err
+}
+
+func (m *RedisWorkerStore) Snapshot() (map[string]peskar.Worker, error) {
+	conn := m.redis.Conn()
+	defer conn.Close()
+	return readAllWorkers(conn)
+}
+
+func (m *RedisWorkerStore) Replace(workers map[string]peskar.Worker) error {
+	return transaction(m.redis, func(conn redis.Conn) error {
+		if err := watch(conn, workersKey()); err != nil {
+			return err
+		}
+		ids, err := redis.Strings(conn.Do("HKEYS", workersKey()))
+		if err != nil {
+			return err
+		}
+		conn.Send("MULTI")
+		conn.Send("DEL", workersKey())
+		// Updates in flight of the removed workers must not restore them.
+		for _, id := range ids {
+			conn.Send("INCR", workerRevKey(id))
+		}
+		for id, worker := range workers {
+			if err := sendWorker(conn, id, worker); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/paradev-ru/peskar-hub/peskar"
+)
+
+// redisTestServer returns a hub keeping jobs and workers in the shared
+// Redis. Hubs need different names to read the log stream separately.
+func redisTestServer(t *testing.T, m *miniredis.Miniredis, name string) *Server {
+	config := Config{
+		ParallelJobCount: 2,
+		DataDir:          t.TempDir(),
+		Store:            StoreRedis,
+		RedisAddr:        "redis://" + m.Addr() + "/0",
+		RedisMaxIdle:     4,
+		RedisStreams:     true,
+		RedisStreamLen:   100,
+		RedisRetryDelay:  10 * time.Millisecond,
+		RedisMaxDelay:    10 * time.Millisecond,
+		RetryMaxAttempts: 1,
+		RetryBackoff:     peskar.BackoffFixed,
+		RequestTimeout:   time.Minute,
+		WorkerTimeout:    time.Minute,
+	}
+	return NewServer(name, &config)
+}
+
+func TestRedisStoreSharedQueue(t *testing.T) {
+	m := miniredis.RunT(t)
+	a := redisTestServer(t, m, "hub-a")
+	b := redisTestServer(t, m, "hub-b")
+	ids := addTestJobs(t, a, 3)
+
+	job, err := b.Dispatch(peskar.Worker{ID: "worker-1"})
+	if err != nil || job == nil {
+		t.Fatal(job, err)
+	}
+	if _, err := a.UpdateState(job.ID, "worker-1", peskar.StateWorking); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.AddLog(job.ID, "worker-1", peskar.LogItem{Message: "Downloading"}); err != nil {
+		t.Fatal(err)
+	}
+	j, err := a.j.Get(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.State != peskar.StateWorking || j.WorkerID != "worker-1" || len(j.LogList()) != 1 {
+		t.Errorf("hub a sees %+v with log %v", j, j.LogList())
+	}
+
+	second, err := a.Dispatch(peskar.Worker{ID: "worker-2"})
+	if err != nil || second == nil || second.ID == job.ID {
+		t.Fatal(second, err)
+	}
+	if _, err := b.Dispatch(peskar.Worker{ID: "worker-3"}); err == nil {
+		t.Error("hub b dispatched over the shared parallel limit")
+	}
+	if _, err := b.j.Delete(ids[2], nil); err != nil {
+		t.Fatal(err)
+	}
+	if jobs, _ := a.j.List(); len(jobs) != 2 {
+		t.Errorf("hub a lists %d jobs, want 2", len(jobs))
+	}
+}
+
+// TestRedisStoreLogOnce checks that a log line from the stream is stored
+// once however many hubs read it.
+func TestRedisStoreLogOnce(t *testing.T) {
+	m := miniredis.RunT(t)
+	a := redisTestServer(t, m, "hub-a")
+	b := redisTestServer(t, m, "hub-b")
+	ids := addTestJobs(t, a, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, s := range []*Server{a, b} {
+		wg.Add(1)
+		go func(s *Server) {
+			defer wg.Done()
+			s.Subscribe(ctx)
+		}(s)
+	}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	const lines = 5
+	for i := 0; i < lines; i++ {
+		log := peskar.LogItem{JobID: ids[0], Message: fmt.Sprintf("Line %d", i)}
+		if err := a.redis.Append(peskar.JobLogChannel, 100, log); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		j, err := a.j.Get(ids[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(j.LogList()); n >= lines || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	j, err := b.j.Get(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(j.LogList()); n != lines {
+		t.Errorf("got %d log items, want %d", n, lines)
+	}
+}
+
+func TestRedisWorkerStoreConcurrentPings(t *testing.T) {
+	m := miniredis.RunT(t)
+	s := redisTestServer(t, m, "hub")
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("worker-%d", i)
+			for n := 0; n < 20; n++ {
+				_, err := s.w.Upsert(id, func(worker *peskar.Worker) error {
+					worker.ID = id
+					worker.State = "active"
+					worker.LastSeenAt = time.Now().UTC()
+					return nil
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	workers, err := s.w.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(workers) != 16 {
+		t.Errorf("got %d workers, want 16", len(workers))
+	}
+	if err := s.DeactivateZombieWorkers(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,6 +3,9 @@ package main
 import (
 	"net"
 	"net/http"
+	"strings"
+
+	"github.com/paradev-ru/peskar-hub/peskar"
 )
 
 func getIP(req *http.Request) string {
@@ -19,3 +22,25 @@ func getIP(req *http.Request) string {
 
 	return realIPRaw
 }
+
+// getWorkerID identifies the worker by its id header or, for workers that
+// do not send one, by IP as on registration.
+func getWorkerID(req *http.Request) string {
+	if id := req.Header.Get(peskar.WorkerIDHeader); id != "" {
+		return id
+	}
+	return getIP(req)
+}
+
+func getList(raw string) []string {
+	if raw == "" {
+		return nil
+	}
+	var list []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
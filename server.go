@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -16,21 +20,49 @@ import (
 )
 
 type Server struct {
-	Name       string
-	startedAt  time.Time
-	config     *Config
-	r          *mux.Router
-	j          map[string]peskar.Job
-	w          map[string]peskar.Worker
-	c          *Client
-	redis      *lib.RedisStore
-	indexerSub *lib.Subscribe
-	weburgMS   *weburg.MovieService
+	Name      string
+	startedAt time.Time
+	config    *Config
+	configMu  sync.RWMutex
+	r         *mux.Router
+	j         JobStore
+	w         WorkerStore
+	c         *Client
+	journal   *Journal
+	redis     *lib.RedisStore
+	events    *Broker
+	sockets   *Sockets
+	webhooks  *Webhooks
+	weburgMS  *weburg.MovieService
+
+	// streams is cancelled when the HTTP server starts shutting down,
+	// it ends the event streams and worker sockets.
+	streams      context.Context
+	closeStreams context.CancelFunc
+
+	subscribersMu sync.Mutex
+	subscribers   map[string]Subscriber
+	running       map[string]bool
+	restarts      map[string]int
 }
 
 type Error struct {
-	Code    int    `json:"code,omitempty"`
-	Message string `json:"message,omitempty"`
+	Code          int            `json:"code,omitempty"`
+	Message       string         `json:"message,omitempty"`
+	AllowedStates []peskar.State `json:"allowed_states,omitempty"`
+	AvailableAt   *time.Time     `json:"available_at,omitempty"`
+}
+
+func (e Error) Error() string {
+	return e.Message
+}
+
+func NewTransitionError(code int, err *peskar.TransitionError) Error {
+	return Error{
+		Code:          code,
+		Message:       err.Error(),
+		AllowedStates: err.Allowed,
+	}
 }
 
 type HttpStatus struct {
@@ -41,22 +73,36 @@ type HttpStatus struct {
 
 func NewServer(name string, config *Config) *Server {
 	weburgCli := weburg.NewClient(http.DefaultClient)
-	client := NewBackend(config.DataDir)
-	redis := lib.NewRedis(config.RedisMaxIdle, config.RedisIdleTimeout, config.RedisAddr)
+	client := NewBackend(config.DataDir, config.DataBackups)
+	redis := lib.NewRedis(config.RedisOptions())
 	hostname, err := os.Hostname()
 	if err != nil {
 		hostname = "na"
 	}
 	s := &Server{
-		Name:   fmt.Sprintf("%s-%s", name, hostname),
-		config: config,
-		j:      make(map[string]peskar.Job),
-		w:      make(map[string]peskar.Worker),
-		c:      client,
-		redis:  redis,
+		Name:     fmt.Sprintf("%s-%s", name, hostname),
+		config:   config,
+		c:        client,
+		redis:    redis,
+		events:   NewBroker(DefaultEventsSize),
+		sockets:  NewSockets(),
+		webhooks: NewWebhooks(client, config.WebhookRetryPolicy(), config.WebhookTimeout),
 		weburgMS: &weburg.MovieService{
 			Client: weburgCli,
 		},
+		running:  make(map[string]bool),
+		restarts: make(map[string]int),
+	}
+	s.subscribers = s.newSubscribers()
+	s.streams, s.closeStreams = context.WithCancel(context.Background())
+	switch config.Store {
+	case StoreRedis:
+		s.j = NewRedisJobStore(redis)
+		s.w = NewRedisWorkerStore(redis)
+	default:
+		s.journal = NewJournal(config.DataDir)
+		s.j = NewMemoryJobStore(s.journal)
+		s.w = NewMemoryWorkerStore()
 	}
 	s.r = mux.NewRouter()
 	s.r.NotFoundHandler = http.HandlerFunc(s.NotFoundHandler)
@@ -67,65 +113,185 @@ func NewServer(name string, config *Config) *Server {
 	v1.HandleFunc("/version/", s.VersionHandler).Methods("GET")
 	v1.HandleFunc("/health/", s.HealthHandler).Methods("GET")
 	v1.HandleFunc("/ping/", s.JobNextHandler).Methods("GET")
+	v1.HandleFunc("/events/", s.EventsHandler).Methods("GET")
+	v1.HandleFunc("/ws/", s.WorkerSocketHandler).Methods("GET")
 	v1.HandleFunc("/worker/", s.WorkerListHandler).Methods("GET")
+	v1.HandleFunc("/worker/", s.WorkerRegisterHandler).Methods("POST")
+	v1.HandleFunc("/worker/{id}/", s.WorkerInfoHandler).Methods("GET")
+	v1.HandleFunc("/worker/{id}/job/", s.WorkerJobListHandler).Methods("GET")
+	v1.HandleFunc("/worker/{id}/schedule/", s.WorkerScheduleHandler).Methods("GET", "PUT")
+	v1.HandleFunc("/webhooks/", s.WebhookListHandler).Methods("GET")
+	v1.HandleFunc("/webhooks/", s.WebhookNewHandler).Methods("POST")
+	v1.HandleFunc("/webhooks/{id}/", s.WebhookInfoHandler).Methods("GET")
+	v1.HandleFunc("/webhooks/{id}/", s.WebhookUpdateHandler).Methods("PUT")
+	v1.HandleFunc("/webhooks/{id}/", s.WebhookDeleteHandler).Methods("DELETE")
+	v1.HandleFunc("/webhooks/{id}/deliveries/", s.WebhookDeliveriesHandler).Methods("GET")
 	v1.HandleFunc("/job/", s.JobListHandler).Methods("GET")
 	v1.HandleFunc("/job/", s.JobNewHandler).Methods("POST")
 	v1.HandleFunc("/job/{id}/", s.ValidateJob(s.JobInfoHandler)).Methods("GET")
 	v1.HandleFunc("/job/{id}/", s.ValidateJob(s.JobUpdateHandler)).Methods("PUT")
 	v1.HandleFunc("/job/{id}/", s.ValidateJob(s.JobDeleteHandler)).Methods("DELETE")
+	v1.HandleFunc("/job/{id}/priority/", s.ValidateJob(s.JobPriorityHandler)).Methods("PUT")
+	v1.HandleFunc("/job/{id}/bump/", s.ValidateJob(s.JobBumpHandler)).Methods("POST")
+	v1.HandleFunc("/job/{id}/lease/", s.ValidateJob(s.JobLeaseHandler)).Methods("POST")
+	v1.HandleFunc("/job/{id}/progress/", s.ValidateJob(s.JobProgressHandler)).Methods("POST")
 	v1.HandleFunc("/job/{id}/log/", s.ValidateJob(s.LogHandler)).Methods("GET", "DELETE")
 	v1.HandleFunc("/job/{id}/log/", s.ValidateJob(s.LogNewHandler)).Methods("POST")
 	v1.HandleFunc("/job/{id}/state_history/", s.ValidateJob(s.StateHistoryHandler)).Methods("GET", "DELETE")
 	return s
 }
 
-func (s *Server) Subscribe() error {
-	if err := s.redis.Check(); err != nil {
-		return err
+func (s *Server) JobProgressReceived(result []byte) error {
+	var progress peskar.Progress
+	if err := json.Unmarshal(result, &progress); err != nil {
+		return lib.Permanent(fmt.Errorf("Unmarshal error: %v (%s)", err, string(result)))
+	}
+	_, err := s.UpdateProgress(progress.JobID, "", progress)
+	return receivedError(progress.JobID, err)
+}
+
+// receivedError marks the errors of Redis messages that would fail again
+// as permanent, so they are not delivered again.
+func receivedError(id string, err error) error {
+	if err == ErrJobNotFound {
+		return lib.Permanent(fmt.Errorf("Job id '%s' not found", id))
+	}
+	if e, ok := err.(Error); ok && e.Code < http.StatusInternalServerError {
+		return lib.Permanent(err)
+	}
+	return err
+}
+
+// UpdateProgress stores the progress of a requested or working job. A
+// progress report also renews the lease of a working job.
+func (s *Server) UpdateProgress(id, workerID string, progress peskar.Progress) (peskar.Job, error) {
+	if err := progress.Validate(); err != nil {
+		return peskar.Job{}, Error{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		}
+	}
+	j, err := s.j.Update(id, func(j *peskar.Job) error {
+		if err := checkHolder(j, workerID); err != nil {
+			return err
+		}
+		switch j.State {
+		case peskar.StateRequested:
+		case peskar.StateWorking:
+			j.Lease(s.config.LeaseDuration)
+		default:
+			return Error{
+				Code:    http.StatusConflict,
+				Message: fmt.Sprintf("Cant report progress of job in state '%s'", j.State),
+			}
+		}
+		j.SetProgress(progress)
+		j.Updated()
+		return nil
+	})
+	if err != nil {
+		return j, err
+	}
+	s.JobEvent(EventJobUpdated, j, j.State, peskar.InitiatorWorker)
+	return j, nil
+}
+
+func (s *Server) JobProgressHandler(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug("Got job-progress request")
+	vars := mux.Vars(r)
+	decoder := json.NewDecoder(r.Body)
+	encoder := json.NewEncoder(w)
+	var progress peskar.Progress
+	if err := decoder.Decode(&progress); err != nil {
+		logrus.Error(err)
+		w.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(Error{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("Error with decoding request body: %v", err),
+		})
+		return
+	}
+	j, err := s.UpdateProgress(vars["id"], getWorkerID(r), progress)
+	if err != nil {
+		s.JobErrorHandler(w, vars["id"], err)
+		return
 	}
-	s.indexerSub = s.redis.NewSubscribe(peskar.JobLogChannel)
-	s.indexerSub.SuccessReceivedCallback = s.JobLogSuccessReceived
-	return s.indexerSub.Run()
+	encoder.Encode(j.Progress)
 }
 
 func (s *Server) JobLogSuccessReceived(result []byte) error {
 	var incommingLog peskar.LogItem
-	var job peskar.Job
 	if err := json.Unmarshal(result, &incommingLog); err != nil {
-		return fmt.Errorf("Unmarshal error: %v (%s)", err, string(result))
+		return lib.Permanent(fmt.Errorf("Unmarshal error: %v (%s)", err, string(result)))
 	}
-	if _, ok := s.j[incommingLog.JobID]; !ok {
-		return fmt.Errorf("Job id '%s' not found", incommingLog.JobID)
+	if incommingLog.Message == "" {
+		return lib.Permanent(fmt.Errorf("Empty message for job '%s'", incommingLog.JobID))
 	}
-	job = s.j[incommingLog.JobID]
-	if incommingLog.Message != "" {
-		job.AddLogItem(incommingLog)
-		s.j[incommingLog.JobID] = job
+	_, err := s.AddLog(incommingLog.JobID, "", incommingLog)
+	return receivedError(incommingLog.JobID, err)
+}
+
+// AddLog appends the item to the job log and returns it as stored.
+func (s *Server) AddLog(id, workerID string, log peskar.LogItem) (peskar.LogItem, error) {
+	var logItem peskar.LogItem
+	_, err := s.j.Update(id, func(job *peskar.Job) error {
+		if err := checkHolder(job, workerID); err != nil {
+			return err
+		}
+		if job.IsHeldBy(workerID) {
+			job.ExtendLease(s.config.LeaseDuration)
+		}
+		logItem = job.AddLogItem(log)
 		return nil
+	})
+	if err != nil {
+		return logItem, err
 	}
-	return fmt.Errorf("Empty message for job '%s'", incommingLog.JobID)
+	logItem.JobID = id
+	s.events.Publish(EventJobLog, id, logItem)
+	return logItem, nil
 }
 
 func (s *Server) ValidateJob(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		if _, ok := s.j[vars["id"]]; !ok {
+		if _, err := s.j.Get(vars["id"]); err != nil {
+			s.JobErrorHandler(w, vars["id"], err)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func (s *Server) JobErrorHandler(w http.ResponseWriter, id string, err error) {
+	encoder := json.NewEncoder(w)
+	switch e := err.(type) {
+	case Error:
+		logrus.Errorf("Job '%s': %s", id, e.Message)
+		w.WriteHeader(e.Code)
+		encoder.Encode(e)
+	default:
+		if err == ErrJobNotFound {
+			logrus.Errorf("Job '%s' not found", id)
 			w.WriteHeader(http.StatusNotFound)
-			logrus.Errorf("Job '%s' not found", vars["id"])
-			encoder := json.NewEncoder(w)
 			encoder.Encode(Error{
 				Code:    http.StatusNotFound,
 				Message: "Job not found",
 			})
 			return
 		}
-		fn(w, r)
+		logrus.Errorf("Job '%s' store error: %v", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(Error{
+			Code:    http.StatusInternalServerError,
+			Message: fmt.Sprintf("Store error: %v", err),
+		})
 	}
 }
 
-func (s *Server) CountActiveJobs() int {
+func countActiveJobs(jobList []peskar.Job) int {
 	var c int
-	for _, job := range s.j {
+	for _, job := range jobList {
 		if job.IsActive() {
 			c++
 		}
@@ -133,38 +299,86 @@ func (s *Server) CountActiveJobs() int {
 	return c
 }
 
-func (s *Server) NextJob() *peskar.Job {
-	for id, job := range s.j {
-		if job.IsAvailable() {
-			job.SetStateSystem("requested")
-			job.Requested()
-			s.j[id] = job
-			return &job
+// NextJob claims the next available job for the worker unless parallel
+// jobs are already active. The count and the claim are one store update,
+// so concurrent dispatches cannot exceed the limit.
+func (s *Server) NextJob(workerID string, urgentOnly bool, parallel int) (*peskar.Job, error) {
+	job, err := s.j.UpdateFirst(func(jobList []peskar.Job) error {
+		if c := countActiveJobs(jobList); c >= parallel {
+			return Error{
+				Code:    http.StatusConflict,
+				Message: fmt.Sprintf("Only %d job(s) cant run parallel, current running %d job(s)", parallel, c),
+			}
+		}
+		return nil
+	}, func(job *peskar.Job) bool {
+		if !job.IsAvailable() || (urgentOnly && !job.Urgent) {
+			return false
 		}
+		job.Attempt++
+		job.SetStateSystem(peskar.StateRequested)
+		job.Requested()
+		job.Lease(s.config.RequestTimeout)
+		job.WorkerID = workerID
+		return true
+	})
+	if err == nil && job != nil {
+		s.JobEvent(EventJobUpdated, *job, peskar.StatePending, peskar.InitiatorSystem)
 	}
-	return nil
+	return job, err
+}
+
+// JobEvent reports a job change to the stream subscribers and to
+// JobEventsChannel, which is a Redis stream with -redis-streams.
+func (s *Server) JobEvent(eventType string, job peskar.Job, previous peskar.State, initiator string) {
+	s.events.PublishJob(eventType, job, previous)
+	event := peskar.NewEvent(eventType, job, previous, initiator)
+	var err error
+	if s.config.RedisStreams {
+		err = s.redis.Append(peskar.JobEventsChannel, s.config.RedisStreamLen, event)
+	} else {
+		err = s.redis.Send(peskar.JobEventsChannel, event)
+	}
+	if err != nil {
+		logrus.Errorf("Could not publish event for job '%s': %v", job.ID, err)
+	}
+}
+
+func initiator(workerID string) string {
+	if workerID != "" {
+		return peskar.InitiatorWorker
+	}
+	return peskar.InitiatorUser
 }
 
 func (s *Server) WorkTimeHandler(w http.ResponseWriter, r *http.Request) {
 	var wt bool
+	var next *time.Time
+	now := time.Now()
+	config := s.runtimeConfig()
+	schedule := config.Schedule()
 	wt = true
-	if s.config.DndEnable {
-		wt = lib.IsAvailable(time.Now(), s.config.DndStartsAt, s.config.DndEndsAt)
+	if config.DndEnable {
+		wt = schedule.IsAvailable(now)
+		if t := schedule.NextTransition(now); !t.IsZero() {
+			next = &t
+		}
 	}
 	encoder := json.NewEncoder(w)
 	encoder.Encode(map[string]interface{}{
-		"local_time":     time.Now(),
-		"local_time_utc": time.Now().UTC(),
-		"dnd_starts_at":  s.config.DndStartsAt,
-		"dnd_ends_at":    s.config.DndEndsAt,
-		"is_work_time":   wt,
-		"dnd_enable":     s.config.DndEnable,
+		"local_time":         now,
+		"local_time_utc":     now.UTC(),
+		"dnd_starts_at":      config.DndStartsAt,
+		"dnd_ends_at":        config.DndEndsAt,
+		"dnd_schedule":       schedule,
+		"is_work_time":       wt,
+		"next_transition_at": next,
+		"dnd_enable":         config.DndEnable,
 	})
 }
 
 func (s *Server) LogNewHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	job := s.j[vars["id"]]
 	var incommingLog peskar.LogItem
 	decoder := json.NewDecoder(r.Body)
 	encoder := json.NewEncoder(w)
@@ -186,46 +400,70 @@ func (s *Server) LogNewHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	incommingLog.Initiator = "api"
-	job.AddLogItem(incommingLog)
-	job.Updated()
-	s.j[vars["id"]] = job
+	incommingLog, err := s.AddLog(vars["id"], r.Header.Get(peskar.WorkerIDHeader), incommingLog)
+	if err != nil {
+		s.JobErrorHandler(w, vars["id"], err)
+		return
+	}
 	w.WriteHeader(http.StatusCreated)
 	encoder.Encode(incommingLog)
 }
 
 func (s *Server) LogHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	job := s.j[vars["id"]]
 	encoder := json.NewEncoder(w)
 	switch r.Method {
 	case "DELETE":
 		logrus.Debug("Got log-delete request")
-		job.DeleteLog()
-		job.Updated()
-		s.j[vars["id"]] = job
+		job, err := s.j.Update(vars["id"], func(job *peskar.Job) error {
+			job.DeleteLog()
+			job.Updated()
+			return nil
+		})
+		if err != nil {
+			s.JobErrorHandler(w, vars["id"], err)
+			return
+		}
+		s.JobEvent(EventJobUpdated, job, job.State, peskar.InitiatorUser)
 		w.WriteHeader(http.StatusOK)
 		return
 	default:
 	case "GET":
+		job, err := s.j.Get(vars["id"])
+		if err != nil {
+			s.JobErrorHandler(w, vars["id"], err)
+			return
+		}
 		encoder.Encode(job.LogList())
 	}
 }
 
 func (s *Server) StateHistoryHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	job := s.j[vars["id"]]
 	encoder := json.NewEncoder(w)
 
 	switch r.Method {
 	case "DELETE":
 		logrus.Debug("Got state_history-delete request")
-		job.DeleteStateHistory()
-		job.Updated()
-		s.j[vars["id"]] = job
+		job, err := s.j.Update(vars["id"], func(job *peskar.Job) error {
+			job.DeleteStateHistory()
+			job.Updated()
+			return nil
+		})
+		if err != nil {
+			s.JobErrorHandler(w, vars["id"], err)
+			return
+		}
+		s.JobEvent(EventJobUpdated, job, job.State, peskar.InitiatorUser)
 		w.WriteHeader(http.StatusOK)
 		return
 	default:
 	case "GET":
+		job, err := s.j.Get(vars["id"])
+		if err != nil {
+			s.JobErrorHandler(w, vars["id"], err)
+			return
+		}
 		encoder.Encode(job.StateHistoryList())
 	}
 }
@@ -293,37 +531,261 @@ func (s *Server) VersionHandler(w http.ResponseWriter, r *http.Request) {
 func (s *Server) WorkerListHandler(w http.ResponseWriter, r *http.Request) {
 	logrus.Debug("Got worker-list request")
 	encoder := json.NewEncoder(w)
-	workerList := []peskar.Worker{}
-	for _, worker := range s.w {
-		workerList = append(workerList, worker)
+	workerList, err := s.w.List()
+	if err != nil {
+		logrus.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(Error{
+			Code:    http.StatusInternalServerError,
+			Message: fmt.Sprintf("Store error: %v", err),
+		})
+		return
 	}
 	encoder.Encode(workerList)
 }
 
-func (s *Server) UpdateWorkerInfo(r *http.Request) {
+func (s *Server) UpdateWorkerInfo(r *http.Request) (peskar.Worker, error) {
+	return s.RegisterWorker(r, peskar.Worker{
+		ID:           r.Header.Get(peskar.WorkerIDHeader),
+		Hostname:     r.Header.Get(peskar.WorkerHostnameHeader),
+		Version:      r.Header.Get(peskar.WorkerVersionHeader),
+		Capabilities: getList(r.Header.Get(peskar.WorkerCapabilitiesHeader)),
+	})
+}
+
+// RegisterWorker marks the worker as active. Workers that do not send
+// their own id are keyed by IP, as before.
+func (s *Server) RegisterWorker(r *http.Request, info peskar.Worker) (peskar.Worker, error) {
 	ip := getIP(r)
-	s.w[ip] = peskar.Worker{
-		IP:         ip,
-		State:      "active",
-		UserAget:   r.Header.Get("User-Agent"),
-		LastSeenAt: time.Now().UTC(),
+	id := info.ID
+	if id == "" {
+		id = ip
+	}
+	var stateChanged bool
+	worker, err := s.w.Upsert(id, func(worker *peskar.Worker) error {
+		stateChanged = worker.State != "active"
+		worker.ID = id
+		worker.IP = ip
+		if info.Hostname != "" {
+			worker.Hostname = info.Hostname
+		}
+		if info.Version != "" {
+			worker.Version = info.Version
+		}
+		if info.Capabilities != nil {
+			worker.Capabilities = info.Capabilities
+		}
+		worker.State = "active"
+		worker.UserAget = r.Header.Get("User-Agent")
+		worker.LastSeenAt = time.Now().UTC()
+		return nil
+	})
+	if err == nil && stateChanged {
+		s.events.Publish(EventWorkerState, "", worker)
+	}
+	return worker, err
+}
+
+func (s *Server) WorkerRegisterHandler(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug("Got worker-register request")
+	encoder := json.NewEncoder(w)
+	var info peskar.Worker
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&info); err != nil {
+		logrus.Error(err)
+		w.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(Error{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("Error with decoding request body: %v", err),
+		})
+		return
+	}
+	if info.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(Error{
+			Code:    http.StatusBadRequest,
+			Message: "Worker id is required",
+		})
+		return
+	}
+	worker, err := s.RegisterWorker(r, info)
+	if err != nil {
+		logrus.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(Error{
+			Code:    http.StatusInternalServerError,
+			Message: fmt.Sprintf("Store error: %v", err),
+		})
+		return
+	}
+	logrus.Infof("Worker '%s' registered from %s", worker.ID, worker.IP)
+	encoder.Encode(worker)
+}
+
+func (s *Server) WorkerJobListHandler(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug("Got worker-job-list request")
+	vars := mux.Vars(r)
+	encoder := json.NewEncoder(w)
+	_, err := s.w.Get(vars["id"])
+	if err == ErrWorkerNotFound {
+		logrus.Errorf("Worker '%s' not found", vars["id"])
+		w.WriteHeader(http.StatusNotFound)
+		encoder.Encode(Error{
+			Code:    http.StatusNotFound,
+			Message: "Worker not found",
+		})
+		return
+	}
+	var jobList []peskar.Job
+	if err == nil {
+		jobList, err = s.j.List()
+	}
+	if err != nil {
+		logrus.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(Error{
+			Code:    http.StatusInternalServerError,
+			Message: fmt.Sprintf("Store error: %v", err),
+		})
+		return
+	}
+	filtered := []peskar.Job{}
+	for _, job := range jobList {
+		if job.IsHeldBy(vars["id"]) {
+			filtered = append(filtered, job)
+		}
+	}
+	peskar.QueueOrder(filtered)
+	encoder.Encode(filtered)
+}
+
+func (s *Server) WorkerInfoHandler(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug("Got worker-info request")
+	vars := mux.Vars(r)
+	encoder := json.NewEncoder(w)
+	worker, err := s.w.Get(vars["id"])
+	if err == ErrWorkerNotFound {
+		logrus.Errorf("Worker '%s' not found", vars["id"])
+		w.WriteHeader(http.StatusNotFound)
+		encoder.Encode(Error{
+			Code:    http.StatusNotFound,
+			Message: "Worker not found",
+		})
+		return
+	}
+	if err != nil {
+		logrus.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(Error{
+			Code:    http.StatusInternalServerError,
+			Message: fmt.Sprintf("Store error: %v", err),
+		})
+		return
+	}
+	encoder.Encode(worker)
+}
+
+// DndState reports whether the global or the worker's own schedule is in
+// the dnd mode and when both of them let the worker download again.
+func (s *Server) DndState(worker peskar.Worker, now time.Time) (bool, time.Time) {
+	var dnd bool
+	var availableAt time.Time
+	wait := func(schedule *lib.Schedule) {
+		dnd = true
+		if t := schedule.NextTransition(now); t.After(availableAt) {
+			availableAt = t
+		}
+	}
+	if config := s.runtimeConfig(); config.DndEnable && !config.Schedule().IsAvailable(now) {
+		wait(config.Schedule())
 	}
+	if !worker.IsAvailable(now) {
+		wait(worker.Schedule)
+	}
+	return dnd, availableAt
+}
+
+func (s *Server) WorkerScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug("Got worker-schedule request")
+	vars := mux.Vars(r)
+	encoder := json.NewEncoder(w)
+	var worker peskar.Worker
+	var err error
+	switch r.Method {
+	case "PUT":
+		var schedule *lib.Schedule
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&schedule); err != nil {
+			logrus.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			encoder.Encode(Error{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf("Error with decoding request body: %v", err),
+			})
+			return
+		}
+		worker, err = s.w.Update(vars["id"], func(worker *peskar.Worker) error {
+			worker.Schedule = schedule
+			return nil
+		})
+		if err == nil {
+			logrus.Infof("Worker '%s' schedule updated", vars["id"])
+		}
+	default:
+		worker, err = s.w.Get(vars["id"])
+	}
+	if err == ErrWorkerNotFound {
+		logrus.Errorf("Worker '%s' not found", vars["id"])
+		w.WriteHeader(http.StatusNotFound)
+		encoder.Encode(Error{
+			Code:    http.StatusNotFound,
+			Message: "Worker not found",
+		})
+		return
+	}
+	if err != nil {
+		logrus.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(Error{
+			Code:    http.StatusInternalServerError,
+			Message: fmt.Sprintf("Store error: %v", err),
+		})
+		return
+	}
+	encoder.Encode(worker.Schedule)
 }
 
 func (s *Server) JobNextHandler(w http.ResponseWriter, r *http.Request) {
 	logrus.Debug("Got job-next request")
-	s.UpdateWorkerInfo(r)
-	c := s.CountActiveJobs()
 	encoder := json.NewEncoder(w)
-	if c >= s.config.ParallelJobCount {
-		w.WriteHeader(http.StatusConflict)
+	worker, err := s.UpdateWorkerInfo(r)
+	if err != nil {
+		logrus.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
 		encoder.Encode(Error{
-			Code:    http.StatusConflict,
-			Message: fmt.Sprintf("Only %d job(s) cant run parallel, current running %d job(s)", s.config.ParallelJobCount, c),
+			Code:    http.StatusInternalServerError,
+			Message: fmt.Sprintf("Store error: %v", err),
+		})
+		return
+	}
+	j, err := s.Dispatch(worker)
+	if e, ok := err.(Error); ok {
+		if e.AvailableAt != nil {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(e.AvailableAt.Sub(time.Now()).Seconds())+1))
+		}
+		w.WriteHeader(e.Code)
+		encoder.Encode(e)
+		return
+	}
+	if err != nil {
+		logrus.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(Error{
+			Code:    http.StatusInternalServerError,
+			Message: fmt.Sprintf("Store error: %v", err),
 		})
 		return
 	}
-	j := s.NextJob()
 	if j == nil {
 		w.WriteHeader(http.StatusNotFound)
 		encoder.Encode(peskar.Job{})
@@ -332,6 +794,32 @@ func (s *Server) JobNextHandler(w http.ResponseWriter, r *http.Request) {
 	encoder.Encode(j)
 }
 
+// Dispatch hands the next job to the worker. It returns nil when the
+// queue is empty and an Error when the worker has to wait.
+func (s *Server) Dispatch(worker peskar.Worker) (*peskar.Job, error) {
+	now := time.Now()
+	dnd, availableAt := s.DndState(worker, now)
+	j, err := s.NextJob(worker.ID, dnd, s.runtimeConfig().ParallelJobCount)
+	if err != nil {
+		return nil, err
+	}
+	if j == nil && dnd {
+		e := Error{
+			Code:    http.StatusServiceUnavailable,
+			Message: "Do not disturb mode is on",
+		}
+		if !availableAt.IsZero() {
+			e.Message = fmt.Sprintf("Do not disturb mode is on until %s", availableAt.Format(time.RFC3339))
+			e.AvailableAt = &availableAt
+		}
+		return nil, e
+	}
+	if j != nil && dnd {
+		logrus.Infof("Job '%s' is urgent, dispatched in do not disturb mode", j.ID)
+	}
+	return j, nil
+}
+
 func (s *Server) JobNewHandler(w http.ResponseWriter, r *http.Request) {
 	logrus.Debug("Got job-new request")
 	var job peskar.Job
@@ -347,6 +835,12 @@ func (s *Server) JobNewHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	j, err := s.AddJob(job)
+	if e, ok := err.(Error); ok {
+		logrus.Error(err)
+		w.WriteHeader(e.Code)
+		encoder.Encode(e)
+		return
+	}
 	if err != nil {
 		logrus.Error(err)
 		w.WriteHeader(http.StatusConflict)
@@ -364,32 +858,181 @@ func (s *Server) JobNewHandler(w http.ResponseWriter, r *http.Request) {
 func (s *Server) JobListHandler(w http.ResponseWriter, r *http.Request) {
 	logrus.Debug("Got job-list request")
 	encoder := json.NewEncoder(w)
-	jobList := []peskar.Job{}
-	for _, job := range s.j {
-		jobList = append(jobList, job)
+	state := peskar.State(r.URL.Query().Get("state"))
+	if state != "" && !state.IsValid() {
+		w.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(Error{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("Unknown state '%s'", state),
+		})
+		return
+	}
+	jobList, err := s.j.List()
+	if err != nil {
+		logrus.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(Error{
+			Code:    http.StatusInternalServerError,
+			Message: fmt.Sprintf("Store error: %v", err),
+		})
+		return
+	}
+	filtered := []peskar.Job{}
+	for _, job := range jobList {
+		if state == "" || job.State == state {
+			filtered = append(filtered, job)
+		}
+	}
+	peskar.QueueOrder(filtered)
+	encoder.Encode(filtered)
+}
+
+func (s *Server) JobPriorityHandler(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug("Got job-priority request")
+	vars := mux.Vars(r)
+	decoder := json.NewDecoder(r.Body)
+	encoder := json.NewEncoder(w)
+	var req struct {
+		Priority *int `json:"priority"`
+	}
+	if err := decoder.Decode(&req); err != nil || req.Priority == nil {
+		if err == nil {
+			err = errors.New("priority is required")
+		}
+		logrus.Error(err)
+		w.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(Error{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("Error with decoding request body: %v", err),
+		})
+		return
+	}
+	job, err := s.SetJobPriority(vars["id"], *req.Priority)
+	if err != nil {
+		s.JobErrorHandler(w, vars["id"], err)
+		return
+	}
+	encoder.Encode(job)
+}
+
+func (s *Server) JobBumpHandler(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug("Got job-bump request")
+	vars := mux.Vars(r)
+	encoder := json.NewEncoder(w)
+	job, err := s.BumpJob(vars["id"])
+	if err != nil {
+		s.JobErrorHandler(w, vars["id"], err)
+		return
+	}
+	encoder.Encode(job)
+}
+
+// BumpJob moves the pending job to the top of the queue. The top is found
+// in the same store update, so concurrent bumps do not end up tied.
+func (s *Server) BumpJob(id string) (peskar.Job, error) {
+	var priority int
+	now := time.Now()
+	job, err := s.j.UpdateFirst(func(jobs []peskar.Job) error {
+		var target, top *peskar.Job
+		for i := range jobs {
+			if jobs[i].ID == id {
+				target = &jobs[i]
+				continue
+			}
+			if jobs[i].IsAvailable() && (top == nil || jobs[i].QueueBefore(top, now)) {
+				top = &jobs[i]
+			}
+		}
+		if target == nil {
+			return ErrJobNotFound
+		}
+		if err := checkReorder(target); err != nil {
+			return err
+		}
+		priority = target.Priority
+		if top != nil && top.Priority >= priority {
+			priority = top.Priority + 1
+		}
+		return nil
+	}, func(job *peskar.Job) bool {
+		if job.ID != id {
+			return false
+		}
+		job.Priority = priority
+		job.Updated()
+		return true
+	})
+	if err != nil {
+		return peskar.Job{}, err
+	}
+	if job == nil {
+		return peskar.Job{}, ErrJobNotFound
+	}
+	s.JobEvent(EventJobUpdated, *job, job.State, peskar.InitiatorUser)
+	logrus.Infof("Job '%s' priority set to %d", job.ID, job.Priority)
+	return *job, nil
+}
+
+func checkReorder(job *peskar.Job) error {
+	if job.State != peskar.StatePending {
+		return Error{
+			Code:    http.StatusConflict,
+			Message: fmt.Sprintf("Only pending jobs can be reordered, job is '%s'", job.State),
+		}
+	}
+	return nil
+}
+
+func (s *Server) SetJobPriority(id string, priority int) (peskar.Job, error) {
+	job, err := s.j.Update(id, func(job *peskar.Job) error {
+		if err := checkReorder(job); err != nil {
+			return err
+		}
+		job.Priority = priority
+		job.Updated()
+		return nil
+	})
+	if err != nil {
+		return peskar.Job{}, err
 	}
-	encoder.Encode(jobList)
+	s.JobEvent(EventJobUpdated, job, job.State, peskar.InitiatorUser)
+	logrus.Infof("Job '%s' priority set to %d", job.ID, job.Priority)
+	return job, nil
 }
 
 func (s *Server) AddJob(job peskar.Job) (peskar.Job, error) {
 	if job.DownloadURL == "" {
 		return peskar.Job{}, errors.New("Download URL cant be empty")
 	}
-	for _, jb := range s.j {
-		if !jb.IsDone() && jb.DownloadURL == job.DownloadURL {
-			return peskar.Job{}, fmt.Errorf("Job for '%s' already exists", jb.DownloadURL)
-		}
-	}
 	jobID, err := RandomUuid()
 	if err != nil {
 		return peskar.Job{}, errors.New("Error generating job ID")
 	}
 
+	if err := job.RetryPolicy(s.config.RetryPolicy()).Validate(); err != nil {
+		return peskar.Job{}, Error{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		}
+	}
+
 	job.ID = jobID
+	job.Revision = 1
+	job.Attempt = 0
+	job.RetryAt = time.Time{}
 	job.Added()
-	job.SetStateSystem("pending")
+	job.SetStateSystem(peskar.StatePending)
 
-	s.j[job.ID] = job
+	err = s.j.Add(job, func(jb peskar.Job) error {
+		if !jb.IsDone() && jb.DownloadURL == job.DownloadURL {
+			return fmt.Errorf("Job for '%s' already exists", jb.DownloadURL)
+		}
+		return nil
+	})
+	if err != nil {
+		return peskar.Job{}, err
+	}
+	s.JobEvent(EventJobCreated, job, "", peskar.InitiatorUser)
 	return job, nil
 }
 
@@ -397,36 +1040,54 @@ func (s *Server) JobInfoHandler(w http.ResponseWriter, r *http.Request) {
 	logrus.Debug("Got job-info request")
 	vars := mux.Vars(r)
 	encoder := json.NewEncoder(w)
-	job := s.j[vars["id"]]
+	job, err := s.j.Get(vars["id"])
+	if err != nil {
+		s.JobErrorHandler(w, vars["id"], err)
+		return
+	}
 	encoder.Encode(job)
 }
 
 func (s *Server) JobDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	logrus.Debug("Got job-delete request")
 	vars := mux.Vars(r)
-	encoder := json.NewEncoder(w)
-	job := s.j[vars["id"]]
-	if !job.IsAvailable() && !job.IsDone() {
-		logrus.Errorf("Cant delete active job '%s'", job.ID)
-		w.WriteHeader(http.StatusForbidden)
-		encoder.Encode(Error{
-			Code:    http.StatusForbidden,
-			Message: "Cant delete active job",
-		})
+	job, err := s.j.Delete(vars["id"], func(job peskar.Job) error {
+		if !job.State.CanTransition(peskar.StateDeleted) {
+			return Error{
+				Code:    http.StatusForbidden,
+				Message: fmt.Sprintf("Cant delete job in state '%s'", job.State),
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.JobErrorHandler(w, vars["id"], err)
 		return
 	}
+	from := job.State
+	job.SetStateSystem(peskar.StateDeleted)
+	job.Revision++
+	s.JobEvent(EventJobDeleted, job, from, peskar.InitiatorUser)
 	logrus.Infof("Job '%s' deleted", job.ID)
-	delete(s.j, job.ID)
 	w.WriteHeader(http.StatusOK)
 }
 
 func (s *Server) JobUpdateHandler(w http.ResponseWriter, r *http.Request) {
 	logrus.Debug("Got job-update request")
 	vars := mux.Vars(r)
-	decoder := json.NewDecoder(r.Body)
 	encoder := json.NewEncoder(w)
 	var job peskar.Job
-	if err := decoder.Decode(&job); err != nil {
+	var flags struct {
+		Urgent *bool `json:"urgent"`
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &job)
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &flags)
+	}
+	if err != nil {
 		logrus.Error(err)
 		w.WriteHeader(http.StatusBadRequest)
 		encoder.Encode(Error{
@@ -436,48 +1097,236 @@ func (s *Server) JobUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	j := s.j[vars["id"]]
+	workerID := r.Header.Get(peskar.WorkerIDHeader)
+	if job.State.IsWorker() {
+		workerID = getWorkerID(r)
+	}
+	var from peskar.State
+	j, err := s.j.Update(vars["id"], func(j *peskar.Job) error {
+		from = j.State
+		if err := checkHolder(j, workerID); err != nil {
+			return err
+		}
+		if j.IsHeldBy(workerID) {
+			j.ExtendLease(s.config.LeaseDuration)
+		}
+		j.Updated()
 
-	j.Updated()
+		if job.InfoURL != "" {
+			j.InfoURL = job.InfoURL
+		}
+		if job.Name != "" {
+			j.Name = job.Name
+		}
+		if job.Description != "" {
+			j.Description = job.Description
+		}
+		if job.MaxAttempts > 0 {
+			j.MaxAttempts = job.MaxAttempts
+		}
+		if job.Backoff != "" {
+			j.Backoff = job.Backoff
+		}
+		if flags.Urgent != nil {
+			j.Urgent = *flags.Urgent
+		}
+		if err := j.RetryPolicy(s.config.RetryPolicy()).Validate(); err != nil {
+			return Error{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
 
-	if job.InfoURL != "" {
-		j.InfoURL = job.InfoURL
+		if job.State != "" && job.State != j.State {
+			if err := s.ApplyState(j, job.State); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.JobErrorHandler(w, vars["id"], err)
+		return
+	}
+	s.JobEvent(EventJobUpdated, j, from, initiator(workerID))
+	logrus.Infof("Job '%s' updated", j.ID)
+	encoder.Encode(j)
+}
+
+// ApplyState switches the job to the state requested by a user or a
+// worker and updates the timestamps, lease and retry that depend on it.
+func (s *Server) ApplyState(j *peskar.Job, state peskar.State) error {
+	from := j.State
+	if err := j.SetStateUser(state); err != nil {
+		return NewTransitionError(http.StatusBadRequest, err.(*peskar.TransitionError))
+	}
+	if state == peskar.StatePending {
+		j.StartedAt = time.Time{}
+		j.FinishedAt = time.Time{}
+		j.Attempt = 0
+		j.RetryAt = time.Time{}
+	}
+	if from == peskar.StateRequested && state == peskar.StateWorking {
+		j.StartedAt = time.Now().UTC()
+		j.Lease(s.config.LeaseDuration)
 	}
-	if job.Name != "" {
-		j.Name = job.Name
+	if j.IsDone() {
+		j.FinishedAt = time.Now().UTC()
 	}
-	if job.Description != "" {
-		j.Description = job.Description
+	if j.Retry(s.config.RetryPolicy()) {
+		logrus.Infof("Job '%s' attempt %d failed, retry at %v", j.ID, j.Attempt, j.RetryAt)
 	}
+	return nil
+}
 
-	if job.State != "" && job.State != j.State {
-		if job.State == "requested" {
-			logrus.Error("Cant change state from '%s' to '%s'", j.State, job.State)
-			w.WriteHeader(http.StatusBadRequest)
-			encoder.Encode(Error{
-				Code:    http.StatusBadRequest,
-				Message: fmt.Sprintf("Cant change state from '%s' to '%s'", j.State, job.State),
-			})
-			return
+// UpdateState switches the state of a job held by the worker.
+func (s *Server) UpdateState(id, workerID string, state peskar.State) (peskar.Job, error) {
+	var from peskar.State
+	j, err := s.j.Update(id, func(j *peskar.Job) error {
+		from = j.State
+		if err := checkHolder(j, workerID); err != nil {
+			return err
 		}
-		if job.State == "pending" {
-			j.StartedAt = time.Time{}
-			j.FinishedAt = time.Time{}
+		if j.IsHeldBy(workerID) {
+			j.ExtendLease(s.config.LeaseDuration)
 		}
-		if j.State == "requested" && job.State == "working" {
-			j.StartedAt = time.Now().UTC()
+		j.Updated()
+		if state == j.State {
+			return nil
 		}
-		if job.IsDone() {
-			j.FinishedAt = time.Now().UTC()
-		}
-		j.SetStateUser(job.State)
-		s.redis.Send(peskar.JobEventsChannel, j)
+		return s.ApplyState(j, state)
+	})
+	if err != nil {
+		return j, err
 	}
+	s.JobEvent(EventJobUpdated, j, from, initiator(workerID))
 	logrus.Infof("Job '%s' updated", j.ID)
-	s.j[vars["id"]] = j
+	return j, nil
+}
+
+func checkHolder(j *peskar.Job, workerID string) error {
+	if workerID != "" && j.WorkerID != "" && j.WorkerID != workerID {
+		return Error{
+			Code:    http.StatusForbidden,
+			Message: fmt.Sprintf("Job '%s' is held by worker '%s'", j.ID, j.WorkerID),
+		}
+	}
+	return nil
+}
+
+func (s *Server) JobLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug("Got job-lease request")
+	vars := mux.Vars(r)
+	encoder := json.NewEncoder(w)
+	j, err := s.RenewLease(vars["id"], getWorkerID(r))
+	if err != nil {
+		s.JobErrorHandler(w, vars["id"], err)
+		return
+	}
 	encoder.Encode(j)
 }
 
+func (s *Server) RenewLease(id, workerID string) (peskar.Job, error) {
+	j, err := s.j.Update(id, func(j *peskar.Job) error {
+		if err := checkHolder(j, workerID); err != nil {
+			return err
+		}
+		switch j.State {
+		case peskar.StateRequested:
+			j.Lease(s.config.RequestTimeout)
+		case peskar.StateWorking:
+			j.Lease(s.config.LeaseDuration)
+		default:
+			return Error{
+				Code:    http.StatusConflict,
+				Message: fmt.Sprintf("Cant renew lease of job in state '%s'", j.State),
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return j, err
+	}
+	s.JobEvent(EventJobUpdated, j, j.State, peskar.InitiatorWorker)
+	logrus.Debugf("Job '%s' lease renewed until %v", j.ID, j.LeaseExpiresAt)
+	return j, nil
+}
+
+func (s *Server) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug("Got events request")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		encoder := json.NewEncoder(w)
+		w.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(Error{
+			Code:    http.StatusInternalServerError,
+			Message: "Streaming is not supported",
+		})
+		return
+	}
+	jobID := r.URL.Query().Get("job_id")
+	types := make(map[string]bool)
+	for _, t := range getList(r.URL.Query().Get("type")) {
+		types[t] = true
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	lastID, _ := strconv.ParseUint(lastEventID, 10, 64)
+
+	ch, backlog := s.events.Subscribe(lastID)
+	defer s.events.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	send := func(e Event) error {
+		if (jobID != "" && e.JobID != jobID) || (len(types) > 0 && !types[e.Type]) {
+			return nil
+		}
+		data, err := json.Marshal(e.Data)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		return err
+	}
+	for _, e := range backlog {
+		if err := send(e); err != nil {
+			logrus.Error(err)
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := send(e); err != nil {
+				logrus.Debug(err)
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.streams.Done():
+			return
+		}
+	}
+}
+
 func (s *Server) NotFoundHandler(w http.ResponseWriter, r *http.Request) {
 	logrus.Error("Page not found")
 	encoder := json.NewEncoder(w)
@@ -489,50 +1338,122 @@ func (s *Server) NotFoundHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	status := "ok"
+	subscribers := s.SubscriberStates()
+	for _, sub := range subscribers {
+		if !sub.Running || !sub.Connected {
+			status = "degraded"
+		}
+	}
 	encoder := json.NewEncoder(w)
+	if status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
 	encoder.Encode(map[string]interface{}{
-		"uptime": time.Since(s.startedAt).String(),
+		"status":      status,
+		"uptime":      time.Since(s.startedAt).String(),
+		"subscribers": subscribers,
 	})
 }
 
-func (s *Server) InvalidateZombieJobs() {
+func (s *Server) InvalidateZombieJobs(ctx context.Context) {
 	zombieTicker := time.NewTicker(time.Minute)
+	defer zombieTicker.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case <-zombieTicker.C:
-			for id, job := range s.j {
-				if !job.IsZombie() {
-					continue
-				}
-				logrus.Debugf("Switch state to 'pending' for job '%s'", job.ID)
-				job.SetStateSystem("pending")
-				s.j[id] = job
+			if err := s.RequeueZombieJobs(); err != nil {
+				logrus.Error(err)
 			}
 		}
 	}
 }
 
-func (s *Server) InvalidateZimbieWorkers() {
+// ReleaseJob returns a job requested by the worker to the queue, e.g.
+// when the job could not be sent to it.
+func (s *Server) ReleaseJob(id, workerID string) error {
+	j, err := s.j.Update(id, func(j *peskar.Job) error {
+		if j.State != peskar.StateRequested || !j.IsHeldBy(workerID) {
+			return Error{
+				Code:    http.StatusConflict,
+				Message: fmt.Sprintf("Job '%s' is not requested by worker '%s'", id, workerID),
+			}
+		}
+		j.SetStateSystem(peskar.StatePending)
+		j.StartedAt = time.Time{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Job '%s' released by worker '%s'", j.ID, workerID)
+	s.JobEvent(EventJobUpdated, j, peskar.StateRequested, peskar.InitiatorSystem)
+	return nil
+}
+
+func (s *Server) RequeueZombieJobs() error {
+	jobs, err := s.j.UpdateAll(func(job *peskar.Job) bool {
+		if !job.IsZombie() {
+			return false
+		}
+		logrus.Debugf("Lease of job '%s' expired, switch state from '%s' to 'pending'", job.ID, job.State)
+		job.SetStateSystem(peskar.StatePending)
+		job.StartedAt = time.Time{}
+		return true
+	})
+	for _, job := range jobs {
+		s.JobEvent(EventJobUpdated, job, lastState(job), peskar.InitiatorSystem)
+	}
+	return err
+}
+
+// lastState returns the state the job had before the last transition.
+func lastState(job peskar.Job) peskar.State {
+	history := job.StateHistoryList()
+	if len(history) == 0 {
+		return ""
+	}
+	return history[len(history)-1].FromState
+}
+
+func (s *Server) InvalidateZimbieWorkers(ctx context.Context) {
 	zombieTicker := time.NewTicker(time.Minute)
+	defer zombieTicker.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case <-zombieTicker.C:
-			for id, worker := range s.w {
-				if !worker.IsZombie() {
-					continue
-				}
-				logrus.Debugf("Switch state to 'inactive' for worker '%s'", worker.IP)
-				worker.State = "inactive"
-				s.w[id] = worker
+			if err := s.DeactivateZombieWorkers(); err != nil {
+				logrus.Error(err)
 			}
 		}
 	}
 }
 
-func (s *Server) PeriodicSave() {
+func (s *Server) DeactivateZombieWorkers() error {
+	workers, err := s.w.UpdateAll(func(worker *peskar.Worker) bool {
+		if !worker.IsZombie(s.config.WorkerTimeout) {
+			return false
+		}
+		logrus.Debugf("Switch state to 'inactive' for worker '%s'", worker.ID)
+		worker.State = "inactive"
+		return true
+	})
+	for _, worker := range workers {
+		s.events.Publish(EventWorkerState, "", worker)
+	}
+	return err
+}
+
+func (s *Server) PeriodicSave(ctx context.Context) {
 	next := time.After(15 * time.Minute)
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case <-next:
 			if err := s.SaveData(); err != nil {
 				logrus.Error(err)
@@ -542,50 +1463,170 @@ func (s *Server) PeriodicSave() {
 	}
 }
 
-func (s *Server) Work() {
-	go s.InvalidateZombieJobs()
-	go s.InvalidateZimbieWorkers()
-	go s.PeriodicSave()
+// Work serves HTTP and runs the background jobs until ctx is done. Then
+// it stops accepting requests, waits for the running ones and stops the
+// background jobs, so that the final snapshot sees every change.
+func (s *Server) Work(ctx context.Context) error {
+	background, stop := context.WithCancel(context.Background())
+	defer stop()
+	var wg sync.WaitGroup
+	run := func(fn func(ctx context.Context)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn(background)
+		}()
+	}
+	run(s.InvalidateZombieJobs)
+	run(s.InvalidateZimbieWorkers)
+	run(s.PeriodicSave)
+	run(func(ctx context.Context) {
+		s.webhooks.Run(ctx, s.events)
+	})
+	run(func(ctx context.Context) {
+		s.Subscribe(ctx)
+	})
 
 	s.startedAt = time.Now()
-	http.Handle("/", &WithCORS{s.r})
-	logrus.Fatal(http.ListenAndServe(s.config.ListenAddr, nil))
+	srv := &http.Server{
+		Addr:    s.config.ListenAddr,
+		Handler: &WithCORS{s.r},
+	}
+	srv.RegisterOnShutdown(s.closeStreams)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		logrus.Info("Waiting for HTTP requests to finish")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+		err = srv.Shutdown(shutdownCtx)
+		cancel()
+		s.sockets.Wait()
+	}
+
+	logrus.Info("Stopping background jobs")
+	stop()
+	wg.Wait()
+	return err
 }
 
 func (s *Server) Load() error {
-	if err := s.LoadData(); err != nil {
+	if err := s.webhooks.Load(); err != nil {
+		logrus.Error(err)
+	}
+	var dataErr error
+	if s.config.Store != StoreRedis {
+		dataErr = s.LoadData()
+		if err := s.LoadJournal(); err != nil {
+			return err
+		}
+	}
+	if err := s.RestoreLeases(); err != nil {
 		return err
 	}
-	return nil
+	return dataErr
+}
+
+// RestoreLeases gives working jobs saved while leases were disabled a
+// lease, otherwise they would never return to the queue.
+func (s *Server) RestoreLeases() error {
+	jobs, err := s.j.UpdateAll(func(job *peskar.Job) bool {
+		return job.RestoreLease(s.config.LeaseDuration)
+	})
+	for _, job := range jobs {
+		logrus.Infof("Job '%s' lease restored until %v", job.ID, job.LeaseExpiresAt)
+	}
+	return err
 }
 
 func (s *Server) Shutdown() error {
 	if err := s.SaveData(); err != nil {
 		return err
 	}
+	if s.journal != nil {
+		return s.journal.Close()
+	}
 	return nil
 }
 
+func (s *Server) LoadJournal() error {
+	if s.journal == nil {
+		return nil
+	}
+	jobs, err := s.j.Snapshot()
+	if err != nil {
+		return err
+	}
+	n, err := s.journal.Replay(jobs)
+	if err != nil {
+		logrus.Errorf("Journal replay stopped: %v", err)
+	}
+	if n > 0 {
+		if err := s.j.Replace(jobs); err != nil {
+			return err
+		}
+		logrus.Infof("Journal entries replayed: %d", n)
+	}
+	return s.journal.Open()
+}
+
 func (s *Server) LoadData() error {
-	if err := s.c.Load("jobs", &s.j); err != nil {
+	snapshot := &JobsSnapshot{}
+	if err := s.c.Load("jobs", snapshot); err != nil {
 		return err
 	}
-	logrus.Infof("Jobs loaded: %d", len(s.j))
-	if err := s.c.Load("workers", &s.w); err != nil {
+	if snapshot.Version < JobsSnapshotVersion {
+		logrus.Infof("Jobs snapshot version %d upgraded to %d", snapshot.Version, JobsSnapshotVersion)
+	}
+	jobs := snapshot.JobMap()
+	if err := s.j.Replace(jobs); err != nil {
+		return err
+	}
+	logrus.Infof("Jobs loaded: %d", len(jobs))
+	workers := make(map[string]peskar.Worker)
+	if err := s.c.Load("workers", &workers); err != nil {
+		return err
+	}
+	for id, worker := range workers {
+		if worker.ID == "" {
+			worker.ID = id
+			workers[id] = worker
+		}
+	}
+	if err := s.w.Replace(workers); err != nil {
 		return err
 	}
-	logrus.Infof("Workers loaded: %d", len(s.w))
+	logrus.Infof("Workers loaded: %d", len(workers))
 	return nil
 }
 
+// SaveData writes the snapshot of the memory store and truncates the
+// journal. Redis keeps the data itself.
 func (s *Server) SaveData() error {
-	if err := s.c.Save("jobs", s.j); err != nil {
+	jobs, ok := s.j.(*MemoryJobStore)
+	if !ok {
+		return nil
+	}
+	return jobs.Compact(s.SaveSnapshot)
+}
+
+func (s *Server) SaveSnapshot(jobs map[string]peskar.Job) error {
+	if err := s.c.Save("jobs", NewJobsSnapshot(jobs)); err != nil {
+		return err
+	}
+	logrus.Infof("Jobs saved: %d", len(jobs))
+	workers, err := s.w.Snapshot()
+	if err != nil {
 		return err
 	}
-	logrus.Infof("Jobs saved: %d", len(s.j))
-	if err := s.c.Save("workers", s.w); err != nil {
+	if err := s.c.Save("workers", workers); err != nil {
 		return err
 	}
-	logrus.Infof("Workers saved: %d", len(s.w))
+	logrus.Infof("Workers saved: %d", len(workers))
 	return nil
 }
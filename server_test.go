@@ -0,0 +1,667 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/paradev-ru/peskar-hub/lib"
+	"github.com/paradev-ru/peskar-hub/peskar"
+)
+
+func init() {
+	logrus.SetOutput(ioutil.Discard)
+}
+
+// testServer returns a hub keeping jobs in memory with the journal in a
+// temporary directory. Redis is not reachable, events only go to the
+// stream subscribers.
+func testServer(t *testing.T, parallel int) *Server {
+	config := Config{
+		ParallelJobCount: parallel,
+		DataDir:          t.TempDir(),
+		Store:            StoreFile,
+		RedisAddr:        "redis://127.0.0.1:1/0",
+		RedisMaxIdle:     1,
+		RetryMaxAttempts: 1,
+		RetryBackoff:     peskar.BackoffFixed,
+		RequestTimeout:   time.Minute,
+		WorkerTimeout:    time.Minute,
+	}
+	s := NewServer(BaseName, &config)
+	if err := s.LoadJournal(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func addTestJobs(t *testing.T, s *Server, n int) []string {
+	var ids []string
+	for i := 0; i < n; i++ {
+		job, err := s.AddJob(peskar.Job{
+			DownloadURL: fmt.Sprintf("http://example.com/%d.torrent", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, job.ID)
+	}
+	return ids
+}
+
+func countActive(t *testing.T, s *Server) int {
+	jobs, err := s.j.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return countActiveJobs(jobs)
+}
+
+func TestDispatchParallelLimit(t *testing.T) {
+	const parallel = 2
+	s := testServer(t, parallel)
+	addTestJobs(t, s, 10)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var dispatched, conflicts int
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			job, err := s.Dispatch(peskar.Worker{ID: fmt.Sprintf("worker-%d", i)})
+			mu.Lock()
+			defer mu.Unlock()
+			if e, ok := err.(Error); ok && e.Code == http.StatusConflict {
+				conflicts++
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if job != nil {
+				dispatched++
+			}
+		}(i)
+	}
+	wg.Wait()
+	if dispatched != parallel {
+		t.Errorf("dispatched %d jobs, want %d", dispatched, parallel)
+	}
+	if conflicts != 20-parallel {
+		t.Errorf("got %d conflicts, want %d", conflicts, 20-parallel)
+	}
+	if c := countActive(t, s); c != parallel {
+		t.Errorf("%d jobs active, want %d", c, parallel)
+	}
+}
+
+func TestDispatchSkipsRetryBackoff(t *testing.T) {
+	s := testServer(t, 1)
+	ids := addTestJobs(t, s, 2)
+	_, err := s.j.Update(ids[0], func(job *peskar.Job) error {
+		job.RetryAt = time.Now().Add(time.Hour)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := s.Dispatch(peskar.Worker{ID: "worker"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job == nil || job.ID != ids[1] {
+		t.Fatalf("dispatched %v, want job '%s'", job, ids[1])
+	}
+}
+
+func TestDndStateWorkerSchedule(t *testing.T) {
+	s := testServer(t, 1)
+	now := time.Date(2026, 10, 12, 3, 0, 0, 0, time.UTC)
+	schedule := &lib.Schedule{
+		Location: time.UTC,
+		Windows:  []lib.Window{{Start: 60, End: 5 * 60}},
+	}
+	tests := []struct {
+		name        string
+		worker      peskar.Worker
+		dnd         bool
+		availableAt time.Time
+	}{
+		{"no schedule", peskar.Worker{ID: "a"}, false, time.Time{}},
+		{"inside the window", peskar.Worker{ID: "b", Schedule: schedule}, true, now.Add(2 * time.Hour)},
+	}
+	for _, tt := range tests {
+		dnd, availableAt := s.DndState(tt.worker, now)
+		if dnd != tt.dnd || !availableAt.Equal(tt.availableAt) {
+			t.Errorf("%s: got %v, %v, want %v, %v", tt.name, dnd, availableAt, tt.dnd, tt.availableAt)
+		}
+	}
+}
+
+// TestConcurrentUpdates interleaves worker and user requests, the zombie
+// tickers and the Redis subscriber callbacks. Run it with -race.
+func TestConcurrentUpdates(t *testing.T) {
+	const parallel = 3
+	s := testServer(t, parallel)
+	s.config.RequestTimeout = 5 * time.Millisecond
+	s.config.LeaseDuration = 20 * time.Millisecond
+	s.config.WorkerTimeout = 10 * time.Millisecond
+	ids := addTestJobs(t, s, 8)
+	h := &WithCORS{s.r}
+
+	do := func(method, url, workerID, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		if workerID != "" {
+			r.Header.Set(peskar.WorkerIDHeader, workerID)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	run := func(fn func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				fn(i)
+			}
+		}()
+	}
+
+	for n := 0; n < 4; n++ {
+		workerID := fmt.Sprintf("worker-%d", n)
+		run(func(i int) {
+			w := do("GET", "/v1/ping/", workerID, "")
+			if w.Code != http.StatusOK {
+				return
+			}
+			var job peskar.Job
+			if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+				t.Error(err)
+				return
+			}
+			url := "/v1/job/" + job.ID + "/"
+			do("PUT", url, workerID, `{"state":"working"}`)
+			do("POST", url+"log/", workerID, `{"message":"Downloading"}`)
+			do("POST", url+"progress/", workerID, `{"bytes_done":10,"bytes_total":100}`)
+			do("POST", url+"lease/", workerID, "")
+			do("PUT", url, workerID, `{"state":"finished"}`)
+			do("PUT", url, "", `{"state":"pending"}`)
+		})
+	}
+	run(func(i int) {
+		if err := s.RequeueZombieJobs(); err != nil {
+			t.Error(err)
+		}
+		if err := s.DeactivateZombieWorkers(); err != nil {
+			t.Error(err)
+		}
+	})
+	run(func(i int) {
+		id := ids[i%len(ids)]
+		s.JobLogSuccessReceived([]byte(`{"job_id":"` + id + `","message":"From Redis"}`))
+		s.JobProgressReceived([]byte(`{"job_id":"` + id + `","bytes_done":1}`))
+	})
+	run(func(i int) {
+		do("GET", "/v1/job/", "", "")
+		do("GET", "/v1/job/"+ids[i%len(ids)]+"/log/", "", "")
+		do("PUT", "/v1/job/"+ids[i%len(ids)]+"/priority/", "", fmt.Sprintf(`{"priority":%d}`, i%5))
+	})
+
+	time.Sleep(500 * time.Millisecond)
+	close(done)
+	wg.Wait()
+
+	if c := countActive(t, s); c > parallel {
+		t.Errorf("%d jobs active, limit is %d", c, parallel)
+	}
+}
+
+// TestWorkerOwnedRequests checks that workers without an id header are
+// identified by IP when they report on a job.
+func TestWorkerOwnedRequests(t *testing.T) {
+	s := testServer(t, 2)
+	addTestJobs(t, s, 2)
+	h := &WithCORS{s.r}
+	do := func(method, url, workerID, remoteAddr, body string) int {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		r.RemoteAddr = remoteAddr
+		if workerID != "" {
+			r.Header.Set(peskar.WorkerIDHeader, workerID)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	legacy, err := s.Dispatch(peskar.Worker{ID: "192.0.2.1"})
+	if err != nil || legacy == nil {
+		t.Fatal(legacy, err)
+	}
+	job, err := s.Dispatch(peskar.Worker{ID: "worker"})
+	if err != nil || job == nil {
+		t.Fatal(job, err)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		workerID   string
+		remoteAddr string
+		body       string
+		code       int
+	}{
+		{"legacy worker starts", "PUT", "/v1/job/" + legacy.ID + "/", "", "192.0.2.1:1234", `{"state":"working"}`, http.StatusOK},
+		{"legacy worker progress", "POST", "/v1/job/" + legacy.ID + "/progress/", "", "192.0.2.1:1234", `{"bytes_done":1}`, http.StatusOK},
+		{"other host finishes", "PUT", "/v1/job/" + legacy.ID + "/", "", "192.0.2.2:1234", `{"state":"finished"}`, http.StatusForbidden},
+		{"start without header", "PUT", "/v1/job/" + job.ID + "/", "", "192.0.2.1:1234", `{"state":"working"}`, http.StatusForbidden},
+		{"progress without header", "POST", "/v1/job/" + job.ID + "/progress/", "", "192.0.2.1:1234", `{"bytes_done":1}`, http.StatusForbidden},
+		{"lease without header", "POST", "/v1/job/" + job.ID + "/lease/", "", "192.0.2.1:1234", "", http.StatusForbidden},
+		{"holder starts", "PUT", "/v1/job/" + job.ID + "/", "worker", "192.0.2.1:1234", `{"state":"working"}`, http.StatusOK},
+		{"user log", "POST", "/v1/job/" + job.ID + "/log/", "", "192.0.2.1:1234", `{"message":"Note"}`, http.StatusCreated},
+		{"user cancels", "PUT", "/v1/job/" + job.ID + "/", "", "192.0.2.2:1234", `{"state":"canceled"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := do(tt.method, tt.url, tt.workerID, tt.remoteAddr, tt.body); code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, code, tt.code)
+		}
+	}
+}
+
+func TestLeaseRenewal(t *testing.T) {
+	s := testServer(t, 1)
+	addTestJobs(t, s, 1)
+	job, err := s.Dispatch(peskar.Worker{ID: "worker"})
+	if err != nil || job == nil {
+		t.Fatal(job, err)
+	}
+	if _, err := s.UpdateState(job.ID, "worker", peskar.StateWorking); err != nil {
+		t.Fatal(err)
+	}
+	if j, _ := s.j.Get(job.ID); !j.LeaseExpiresAt.IsZero() {
+		t.Fatalf("lease expires at %v with leases disabled", j.LeaseExpiresAt)
+	}
+
+	s.config.LeaseDuration = time.Hour
+	expired := time.Now().UTC().Add(-time.Minute)
+	if _, err := s.j.Update(job.ID, func(j *peskar.Job) error {
+		j.LeaseExpiresAt = expired
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddLog(job.ID, "", peskar.LogItem{Message: "From a user"}); err != nil {
+		t.Fatal(err)
+	}
+	if j, _ := s.j.Get(job.ID); !j.LeaseExpiresAt.Equal(expired) {
+		t.Errorf("user log renewed the lease until %v", j.LeaseExpiresAt)
+	}
+	if _, err := s.AddLog(job.ID, "worker", peskar.LogItem{Message: "From the worker"}); err != nil {
+		t.Fatal(err)
+	}
+	if j, _ := s.j.Get(job.ID); !j.LeaseExpiresAt.After(time.Now().Add(30 * time.Minute)) {
+		t.Errorf("worker log did not renew the lease, expires at %v", j.LeaseExpiresAt)
+	}
+}
+
+func TestRestoreLeases(t *testing.T) {
+	s := testServer(t, 1)
+	addTestJobs(t, s, 1)
+	job, err := s.Dispatch(peskar.Worker{ID: "worker"})
+	if err != nil || job == nil {
+		t.Fatal(job, err)
+	}
+	j, err := s.UpdateState(job.ID, "worker", peskar.StateWorking)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.config.LeaseDuration = time.Hour
+	s2 := reopen(t, s)
+	if err := s2.RestoreLeases(); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := s2.j.Get(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := j.StartedAt.Add(time.Hour); !restored.LeaseExpiresAt.Equal(want) {
+		t.Errorf("lease expires at %v, want %v", restored.LeaseExpiresAt, want)
+	}
+}
+
+func TestReceivedPermanentErrors(t *testing.T) {
+	s := testServer(t, 1)
+	ids := addTestJobs(t, s, 1)
+	tests := []struct {
+		name      string
+		message   string
+		err       bool
+		permanent bool
+	}{
+		{"log", `{"job_id":"` + ids[0] + `","message":"Line"}`, false, false},
+		{"malformed", `{"job_id":`, true, true},
+		{"empty message", `{"job_id":"` + ids[0] + `"}`, true, true},
+		{"unknown job", `{"job_id":"unknown","message":"Line"}`, true, true},
+	}
+	for _, tt := range tests {
+		err := s.JobLogSuccessReceived([]byte(tt.message))
+		if (err != nil) != tt.err {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+		if _, ok := err.(lib.PermanentError); ok != tt.permanent {
+			t.Errorf("%s: %v is permanent: %v, want %v", tt.name, err, ok, tt.permanent)
+		}
+	}
+	if err := s.JobProgressReceived([]byte(`{"job_id":"` + ids[0] + `","bytes_done":1}`)); err == nil {
+		t.Error("progress of a pending job accepted")
+	} else if _, ok := err.(lib.PermanentError); !ok {
+		t.Errorf("%v is not permanent", err)
+	}
+}
+
+type testSubscriber struct {
+	connected bool
+}
+
+func (t testSubscriber) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (t testSubscriber) State() lib.SubscribeState {
+	return lib.SubscribeState{Connected: t.connected}
+}
+
+func (t testSubscriber) Channels() []string {
+	return []string{"test"}
+}
+
+func TestHealthStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		running   bool
+		connected bool
+		code      int
+		status    string
+	}{
+		{"connected", true, true, http.StatusOK, "ok"},
+		{"disconnected", true, false, http.StatusServiceUnavailable, "degraded"},
+		{"waiting for a restart", false, true, http.StatusServiceUnavailable, "degraded"},
+	}
+	for _, tt := range tests {
+		s := testServer(t, 1)
+		s.subscribers = map[string]Subscriber{"test": testSubscriber{tt.connected}}
+		s.subscriberRunning("test", tt.running)
+		w := httptest.NewRecorder()
+		s.HealthHandler(w, httptest.NewRequest("GET", "/v1/health/", nil))
+		var health struct {
+			Status string `json:"status"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.code || health.Status != tt.status {
+			t.Errorf("%s: got %d %s, want %d %s", tt.name, w.Code, health.Status, tt.code, tt.status)
+		}
+	}
+}
+
+func TestRedisRetryingCancel(t *testing.T) {
+	s := testServer(t, 1)
+	s.config.RedisRetryDelay = time.Hour
+	s.config.RedisMaxDelay = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	done := make(chan error)
+	go func() {
+		done <- s.RedisRetrying(ctx, 1, time.Second)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RedisRetrying ignores the cancelled context")
+	}
+}
+
+func TestSocketsWait(t *testing.T) {
+	sockets := NewSockets()
+	sockets.Open("worker")
+	release := make(chan struct{})
+	var finished bool
+	sockets.Go(func() {
+		<-release
+		finished = true
+	})
+	sockets.Done()
+	time.AfterFunc(10*time.Millisecond, func() { close(release) })
+	sockets.Wait()
+	if !finished {
+		t.Error("Wait returned before the socket reader")
+	}
+}
+
+func TestConcurrentBumps(t *testing.T) {
+	s := testServer(t, 1)
+	ids := addTestJobs(t, s, 8)
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if _, err := s.BumpJob(id); err != nil {
+				t.Error(err)
+			}
+		}(id)
+	}
+	wg.Wait()
+	jobs, err := s.j.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	priorities := make(map[int]string)
+	for _, job := range jobs {
+		if other, ok := priorities[job.Priority]; ok {
+			t.Errorf("jobs '%s' and '%s' share priority %d", job.ID, other, job.Priority)
+		}
+		priorities[job.Priority] = job.ID
+	}
+	if _, err := s.BumpJob("unknown"); err != ErrJobNotFound {
+		t.Errorf("bumping an unknown job: %v", err)
+	}
+}
+
+// failingWorkerStore fails to register workers.
+type failingWorkerStore struct {
+	WorkerStore
+}
+
+func (f failingWorkerStore) Upsert(id string, fn func(worker *peskar.Worker) error) (peskar.Worker, error) {
+	return peskar.Worker{}, fmt.Errorf("Worker store is down")
+}
+
+func TestPingRegistrationError(t *testing.T) {
+	s := testServer(t, 1)
+	addTestJobs(t, s, 1)
+	s.w = failingWorkerStore{s.w}
+	w := httptest.NewRecorder()
+	s.r.ServeHTTP(w, httptest.NewRequest("GET", "/v1/ping/", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if c := countActive(t, s); c != 0 {
+		t.Errorf("%d jobs dispatched to an unregistered worker", c)
+	}
+}
+
+// serveTest sends a request from remoteAddr with the given headers.
+func serveTest(s *Server, method, url, remoteAddr string, header map[string]string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	r.RemoteAddr = remoteAddr
+	for key, value := range header {
+		r.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	s.r.ServeHTTP(w, r)
+	return w
+}
+
+func TestWorkerIdentity(t *testing.T) {
+	s := testServer(t, 1)
+	pings := []struct {
+		remoteAddr string
+		header     map[string]string
+	}{
+		{"10.0.0.1:1000", map[string]string{
+			peskar.WorkerIDHeader:           "nas-1",
+			peskar.WorkerHostnameHeader:     "nas",
+			peskar.WorkerVersionHeader:      "0.3.0",
+			peskar.WorkerCapabilitiesHeader: "http, torrent",
+		}},
+		{"10.0.0.1:1001", map[string]string{peskar.WorkerIDHeader: "nas-2"}},
+		{"10.0.0.9:1000", map[string]string{peskar.WorkerIDHeader: "nas-1"}},
+		{"10.0.0.5:1000", nil},
+	}
+	for _, p := range pings {
+		if w := serveTest(s, "GET", "/v1/ping/", p.remoteAddr, p.header, ""); w.Code != http.StatusNotFound {
+			t.Fatalf("ping from %s: got %d, want %d", p.remoteAddr, w.Code, http.StatusNotFound)
+		}
+	}
+	if w := serveTest(s, "POST", "/v1/worker/", "10.0.0.7:1000", nil, `{"id":"nas-3","hostname":"backup"}`); w.Code != http.StatusOK {
+		t.Fatalf("register: got %d", w.Code)
+	}
+	if w := serveTest(s, "POST", "/v1/worker/", "10.0.0.7:1000", nil, `{"hostname":"backup"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("register without id: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	var workers []peskar.Worker
+	w := serveTest(s, "GET", "/v1/worker/", "10.0.0.2:1000", nil, "")
+	if err := json.Unmarshal(w.Body.Bytes(), &workers); err != nil {
+		t.Fatal(err)
+	}
+	if len(workers) != 4 {
+		t.Errorf("got %d workers, want 4: %+v", len(workers), workers)
+	}
+
+	tests := []struct {
+		id       string
+		ip       string
+		hostname string
+		caps     []string
+	}{
+		{"nas-1", "10.0.0.9", "nas", []string{"http", "torrent"}},
+		{"nas-2", "10.0.0.1", "", nil},
+		{"10.0.0.5", "10.0.0.5", "", nil},
+		{"nas-3", "10.0.0.7", "backup", nil},
+	}
+	for _, tt := range tests {
+		w := serveTest(s, "GET", "/v1/worker/"+tt.id+"/", "10.0.0.2:1000", nil, "")
+		var worker peskar.Worker
+		if err := json.Unmarshal(w.Body.Bytes(), &worker); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusOK || worker.ID != tt.id || worker.IP != tt.ip || worker.Hostname != tt.hostname ||
+			strings.Join(worker.Capabilities, ",") != strings.Join(tt.caps, ",") || worker.State != "active" {
+			t.Errorf("worker '%s': got %d %+v", tt.id, w.Code, worker)
+		}
+	}
+	if w := serveTest(s, "GET", "/v1/worker/unknown/", "10.0.0.2:1000", nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown worker: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestWorkerJobList(t *testing.T) {
+	s := testServer(t, 1)
+	addTestJobs(t, s, 1)
+	header := map[string]string{peskar.WorkerIDHeader: "nas-1"}
+	w := serveTest(s, "GET", "/v1/ping/", "10.0.0.1:1000", header, "")
+	var job peskar.Job
+	if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil || w.Code != http.StatusOK {
+		t.Fatal(w.Code, err)
+	}
+	if job.WorkerID != "nas-1" || job.State != peskar.StateRequested {
+		t.Errorf("dispatched %+v", job)
+	}
+	var jobs []peskar.Job
+	w = serveTest(s, "GET", "/v1/worker/nas-1/job/", "10.0.0.2:1000", nil, "")
+	if err := json.Unmarshal(w.Body.Bytes(), &jobs); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != job.ID {
+		t.Errorf("worker jobs: %+v", jobs)
+	}
+}
+
+func TestJobProgressHandler(t *testing.T) {
+	s := testServer(t, 1)
+	ids := addTestJobs(t, s, 1)
+	url := "/v1/job/" + ids[0] + "/"
+	header := map[string]string{peskar.WorkerIDHeader: "worker"}
+	if w := serveTest(s, "POST", url+"progress/", "10.0.0.1:1000", header, `{"bytes_done":1}`); w.Code != http.StatusConflict {
+		t.Errorf("progress of a pending job: got %d, want %d", w.Code, http.StatusConflict)
+	}
+	if job, err := s.Dispatch(peskar.Worker{ID: "worker"}); err != nil || job == nil {
+		t.Fatal(job, err)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"report", `{"phase":"downloading","bytes_done":5,"bytes_total":10,"speed":2,"eta":3}`, http.StatusOK},
+		{"malformed", `{"bytes_done":`, http.StatusBadRequest},
+		{"negative", `{"bytes_done":-1}`, http.StatusBadRequest},
+		{"done over total", `{"bytes_done":11,"bytes_total":10}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := serveTest(s, "POST", url+"progress/", "10.0.0.1:1000", header, tt.body); w.Code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.code)
+		}
+	}
+
+	var job peskar.Job
+	w := serveTest(s, "GET", url, "10.0.0.2:1000", nil, "")
+	if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	p := job.Progress
+	if p == nil || p.Phase != "downloading" || p.BytesDone != 5 || p.BytesTotal != 10 || p.Speed != 2 || p.ETA != 3 || p.UpdatedAt.IsZero() {
+		t.Errorf("job progress: %+v", p)
+	}
+
+	if err := s.JobProgressReceived([]byte(`{"job_id":"` + ids[0] + `","bytes_done":7,"bytes_total":10}`)); err != nil {
+		t.Fatal(err)
+	}
+	if j, _ := s.j.Get(ids[0]); j.Progress == nil || j.Progress.BytesDone != 7 || j.Progress.JobID != "" {
+		t.Errorf("progress from Redis: %+v", j.Progress)
+	}
+
+	if w := serveTest(s, "PUT", url, "10.0.0.2:1000", nil, `{"state":"pending"}`); w.Code != http.StatusOK {
+		t.Fatalf("requeue: got %d", w.Code)
+	}
+	if j, _ := s.j.Get(ids[0]); j.Progress != nil {
+		t.Errorf("requeued job keeps progress %+v", j.Progress)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/paradev-ru/peskar-hub/peskar"
+)
+
+const (
+	JobsSnapshotVersion = 2
+)
+
+// JobsSnapshot is the on-disk format of jobs.json. Version 1 files are
+// plain maps of job ID to job, as written by hubs up to 0.1.2.
+type JobsSnapshot struct {
+	Version int                         `json:"version"`
+	Jobs    map[string]peskar.JobRecord `json:"jobs"`
+}
+
+func NewJobsSnapshot(jobs map[string]peskar.Job) *JobsSnapshot {
+	s := &JobsSnapshot{
+		Version: JobsSnapshotVersion,
+		Jobs:    make(map[string]peskar.JobRecord),
+	}
+	for id, job := range jobs {
+		s.Jobs[id] = job.Record()
+	}
+	return s
+}
+
+func (s *JobsSnapshot) JobMap() map[string]peskar.Job {
+	jobs := make(map[string]peskar.Job)
+	for id, record := range s.Jobs {
+		jobs[id] = record.Restore()
+	}
+	return jobs
+}
+
+func (s *JobsSnapshot) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if _, ok := raw["version"]; !ok {
+		s.Version = 1
+		s.Jobs = make(map[string]peskar.JobRecord)
+		return json.Unmarshal(data, &s.Jobs)
+	}
+	type snapshot JobsSnapshot
+	var v snapshot
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if v.Version > JobsSnapshotVersion {
+		return fmt.Errorf("Unsupported jobs snapshot version: %d", v.Version)
+	}
+	if v.Jobs == nil {
+		v.Jobs = make(map[string]peskar.JobRecord)
+	}
+	*s = JobsSnapshot(v)
+	return nil
+}
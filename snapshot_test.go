@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/paradev-ru/peskar-hub/peskar"
+)
+
+func TestJobsSnapshotUnmarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		version int
+		jobs    int
+		log     int
+		err     bool
+	}{
+		{
+			name:    "v1",
+			data:    `{"a":{"id":"a","state":"pending","download_url":"http://example.com/a.torrent"},"b":{"id":"b","state":"finished"}}`,
+			version: 1,
+			jobs:    2,
+		},
+		{
+			name:    "v1 empty",
+			data:    `{}`,
+			version: 1,
+		},
+		{
+			name:    "v2",
+			data:    `{"version":2,"jobs":{"a":{"id":"a","state":"working","log":[{"initiator":"worker","message":"Started"}]}}}`,
+			version: 2,
+			jobs:    1,
+			log:     1,
+		},
+		{
+			name:    "v2 without jobs",
+			data:    `{"version":2}`,
+			version: 2,
+		},
+		{
+			name: "newer version",
+			data: `{"version":3,"jobs":{}}`,
+			err:  true,
+		},
+		{
+			name: "not an object",
+			data: `[]`,
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s JobsSnapshot
+			err := json.Unmarshal([]byte(tt.data), &s)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Version != tt.version {
+				t.Errorf("version = %d, want %d", s.Version, tt.version)
+			}
+			jobs := s.JobMap()
+			if len(jobs) != tt.jobs {
+				t.Fatalf("got %d jobs, want %d", len(jobs), tt.jobs)
+			}
+			if tt.log > 0 {
+				job := jobs["a"]
+				if len(job.LogList()) != tt.log {
+					t.Errorf("got %d log items, want %d", len(job.LogList()), tt.log)
+				}
+			}
+		})
+	}
+}
+
+func TestJobsSnapshotUpgrade(t *testing.T) {
+	v1 := `{"a":{"id":"a","state":"pending","name":"Movie","priority":5}}`
+	var old JobsSnapshot
+	if err := json.Unmarshal([]byte(v1), &old); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(NewJobsSnapshot(old.JobMap()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s JobsSnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Version != JobsSnapshotVersion {
+		t.Fatalf("version = %d, want %d", s.Version, JobsSnapshotVersion)
+	}
+	job, ok := s.JobMap()["a"]
+	if !ok {
+		t.Fatal("job 'a' is lost")
+	}
+	if job.State != peskar.StatePending || job.Name != "Movie" || job.Priority != 5 {
+		t.Errorf("job changed: %+v", job)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/paradev-ru/peskar-hub/peskar"
+)
+
+var (
+	ErrJobNotFound    = errors.New("Job not found")
+	ErrWorkerNotFound = errors.New("Worker not found")
+)
+
+// JobStore keeps jobs by ID. Every callback passed to a store method is
+// executed atomically with respect to other calls on the same store, so
+// read-modify-write sequences must happen inside the callback. Jobs
+// passed by List, Add, UpdateFirst and UpdateAll may come without their
+// log and state history, Get, Update and Snapshot return them.
+// UpdateFirst passes all jobs to check first and then offers them to fn
+// in peskar.QueueOrder, so a limit can be checked and a job claimed in
+// one step. Updates bump the job revision in the same step, so events
+// can be ordered by it.
+type JobStore interface {
+	Get(id string) (peskar.Job, error)
+	List() ([]peskar.Job, error)
+	Add(job peskar.Job, check func(existing peskar.Job) error) error
+	Update(id string, fn func(job *peskar.Job) error) (peskar.Job, error)
+	UpdateFirst(check func(jobs []peskar.Job) error, fn func(job *peskar.Job) bool) (*peskar.Job, error)
+	UpdateAll(fn func(job *peskar.Job) bool) ([]peskar.Job, error)
+	Delete(id string, check func(job peskar.Job) error) (peskar.Job, error)
+	Snapshot() (map[string]peskar.Job, error)
+	Replace(jobs map[string]peskar.Job) error
+}
+
+// WorkerStore keeps workers by ID with the same atomicity guarantees as
+// JobStore.
+type WorkerStore interface {
+	Get(id string) (peskar.Worker, error)
+	List() ([]peskar.Worker, error)
+	Update(id string, fn func(worker *peskar.Worker) error) (peskar.Worker, error)
+	Upsert(id string, fn func(worker *peskar.Worker) error) (peskar.Worker, error)
+	UpdateAll(fn func(worker *peskar.Worker) bool) ([]peskar.Worker, error)
+	Snapshot() (map[string]peskar.Worker, error)
+	Replace(workers map[string]peskar.Worker) error
+}
+
+// bumpRevision sets the revision of job to the one following old, unless
+// only the log or the state history changed.
+func bumpRevision(old, job *peskar.Job) (bool, error) {
+	job.Revision = old.Revision
+	oldFields, err := jobFields(*old)
+	if err != nil {
+		return false, err
+	}
+	fields, err := jobFields(*job)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(oldFields, fields) {
+		return false, nil
+	}
+	job.Revision++
+	return true, nil
+}
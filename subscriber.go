@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/paradev-ru/peskar-hub/lib"
+	"github.com/paradev-ru/peskar-hub/peskar"
+)
+
+const (
+	SubscriberPubSub = "pubsub"
+	SubscriberStream = "stream"
+)
+
+type Subscriber interface {
+	Run(ctx context.Context) error
+	State() lib.SubscribeState
+	Channels() []string
+}
+
+type SubscriberState struct {
+	Name     string   `json:"name"`
+	Channels []string `json:"channels"`
+	Running  bool     `json:"running"`
+	lib.SubscribeState
+	Restarts int `json:"restarts,omitempty"`
+}
+
+// newSubscribers listens to all Pub/Sub channels on one connection. With
+// -redis-streams the logs are read from a stream by a separate consumer.
+func (s *Server) newSubscribers() map[string]Subscriber {
+	subscribers := make(map[string]Subscriber)
+	pubsub := s.redis.NewSubscribe()
+	pubsub.RetryingPolicyCallback = s.RedisRetrying
+	pubsub.Handle(peskar.JobProgressChannel, s.JobProgressReceived)
+	if s.config.RedisStreams {
+		logStream := s.redis.NewStreamConsumer(peskar.JobLogChannel, RedisStreamGroup, s.Name)
+		logStream.SuccessReceivedCallback = s.JobLogSuccessReceived
+		logStream.RetryingPolicyCallback = s.RedisRetrying
+		subscribers[SubscriberStream] = logStream
+	} else {
+		pubsub.Handle(peskar.JobLogChannel, s.JobLogSuccessReceived)
+	}
+	subscribers[SubscriberPubSub] = pubsub
+	return subscribers
+}
+
+// Subscribe runs the subscribers until ctx is done. A subscriber that
+// gives up or panics is restarted after a delay.
+func (s *Server) Subscribe(ctx context.Context) error {
+	if err := s.redis.Check(); err != nil {
+		logrus.Errorf("Redis is not available: %v", err)
+	}
+	var wg sync.WaitGroup
+	for name, sub := range s.subscribers {
+		wg.Add(1)
+		go func(name string, sub Subscriber) {
+			defer wg.Done()
+			s.supervise(ctx, name, sub)
+		}(name, sub)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (s *Server) supervise(ctx context.Context, name string, sub Subscriber) {
+	policy := s.config.RedisRetryPolicy()
+	for restarts := 1; ; restarts++ {
+		s.subscriberRunning(name, true)
+		err := runSubscriber(ctx, sub)
+		s.subscriberRunning(name, false)
+		if ctx.Err() != nil {
+			return
+		}
+		s.subscriberRestarted(name)
+		delay := policy.Next(restarts)
+		logrus.Errorf("Subscriber '%s' stopped: %v, restarting in %v", name, err, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func runSubscriber(ctx context.Context, sub Subscriber) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return sub.Run(ctx)
+}
+
+func (s *Server) subscriberRunning(name string, running bool) {
+	s.subscribersMu.Lock()
+	defer s.subscribersMu.Unlock()
+	s.running[name] = running
+}
+
+func (s *Server) subscriberRestarted(name string) {
+	s.subscribersMu.Lock()
+	defer s.subscribersMu.Unlock()
+	s.restarts[name]++
+}
+
+func (s *Server) SubscriberStates() []SubscriberState {
+	s.subscribersMu.Lock()
+	defer s.subscribersMu.Unlock()
+	var states []SubscriberState
+	for name, sub := range s.subscribers {
+		states = append(states, SubscriberState{
+			Name:           name,
+			Channels:       sub.Channels(),
+			Running:        s.running[name],
+			SubscribeState: sub.State(),
+			Restarts:       s.restarts[name],
+		})
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Name < states[j].Name
+	})
+	return states
+}
+
+// RedisRetrying waits before the next connection attempt of a subscriber,
+// or until ctx is done, and gives up after -redis-retry-timeout.
+func (s *Server) RedisRetrying(ctx context.Context, attempts int, duration time.Duration) error {
+	if s.config.RedisGiveUpAfter > 0 && duration >= s.config.RedisGiveUpAfter {
+		return fmt.Errorf("Redis connection refused for %v", duration)
+	}
+	delay := s.config.RedisRetryPolicy().Next(attempts)
+	logrus.Debugf("Wait Redis for %v (#%d, %v)", delay, attempts, duration)
+	select {
+	case <-ctx.Done():
+	case <-time.After(delay):
+	}
+	return nil
+}
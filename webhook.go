@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/paradev-ru/peskar-hub/peskar"
+)
+
+const (
+	WebhookSignatureHeader = "X-Peskar-Signature"
+	WebhookEventHeader     = "X-Peskar-Event"
+	WebhookDeliveryHeader  = "X-Peskar-Delivery"
+	webhookDeliveriesSize  = 50
+)
+
+var (
+	ErrWebhookNotFound = errors.New("Webhook not found")
+
+	webhookEvents = map[string]bool{
+		EventJobCreated:  true,
+		EventJobUpdated:  true,
+		EventJobDeleted:  true,
+		EventJobLog:      true,
+		EventWorkerState: true,
+	}
+)
+
+// Webhook is a subscription to hub events. Empty Events and States match
+// everything, States only filter job events.
+type Webhook struct {
+	ID        string         `json:"id"`
+	URL       string         `json:"url"`
+	Events    []string       `json:"events,omitempty"`
+	States    []peskar.State `json:"states,omitempty"`
+	Secret    string         `json:"secret,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+type Delivery struct {
+	ID          string    `json:"id"`
+	EventID     uint64    `json:"event_id"`
+	Event       string    `json:"event"`
+	Attempt     int       `json:"attempt"`
+	Success     bool      `json:"success"`
+	StatusCode  int       `json:"status_code,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	DeliveredAt time.Time `json:"delivered_at"`
+	NextRetryAt time.Time `json:"next_retry_at,omitempty"`
+}
+
+type WebhookPayload struct {
+	Delivery      string       `json:"delivery"`
+	Event         string       `json:"event"`
+	JobID         string       `json:"job_id,omitempty"`
+	PreviousState peskar.State `json:"previous_state,omitempty"`
+	CreatedAt     time.Time    `json:"created_at"`
+	Data          interface{}  `json:"data"`
+}
+
+func (h Webhook) Validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid webhook URL '%s'", h.URL)
+	}
+	for _, e := range h.Events {
+		if !webhookEvents[e] {
+			return fmt.Errorf("Unknown event '%s'", e)
+		}
+	}
+	for _, state := range h.States {
+		if !state.IsValid() {
+			return fmt.Errorf("Unknown state '%s'", state)
+		}
+	}
+	return nil
+}
+
+func (h Webhook) Matches(e Event) bool {
+	if len(h.Events) > 0 && !containsString(h.Events, e.Type) {
+		return false
+	}
+	if len(h.States) == 0 {
+		return true
+	}
+	job, ok := e.Data.(peskar.Job)
+	if !ok {
+		return false
+	}
+	// Updates that keep the state, e.g. a new priority, are not reported
+	// again to the subscribers of that state.
+	if e.Type == EventJobUpdated && e.PreviousState == job.State {
+		return false
+	}
+	for _, state := range h.States {
+		if job.State == state {
+			return true
+		}
+	}
+	return false
+}
+
+// Public hides the secret from API responses.
+func (h Webhook) Public() Webhook {
+	h.Secret = ""
+	return h
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign returns the value of the signature header: hex encoded
+// HMAC-SHA256 of the body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type Webhooks struct {
+	mu         sync.RWMutex
+	hooks      map[string]Webhook
+	deliveries map[string][]Delivery
+	c          *Client
+	client     *http.Client
+	policy     peskar.RetryPolicy
+}
+
+func NewWebhooks(c *Client, policy peskar.RetryPolicy, timeout time.Duration) *Webhooks {
+	return &Webhooks{
+		hooks:      make(map[string]Webhook),
+		deliveries: make(map[string][]Delivery),
+		c:          c,
+		client:     &http.Client{Timeout: timeout},
+		policy:     policy,
+	}
+}
+
+func (w *Webhooks) Load() error {
+	hooks := make(map[string]Webhook)
+	if err := w.c.Load("webhooks", &hooks); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.hooks = hooks
+	logrus.Infof("Webhooks loaded: %d", len(hooks))
+	return nil
+}
+
+func (w *Webhooks) List() []Webhook {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	list := make([]Webhook, 0, len(w.hooks))
+	for _, h := range w.hooks {
+		list = append(list, h)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+func (w *Webhooks) Get(id string) (Webhook, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	h, ok := w.hooks[id]
+	if !ok {
+		return Webhook{}, ErrWebhookNotFound
+	}
+	return h, nil
+}
+
+func (w *Webhooks) Add(h Webhook) (Webhook, error) {
+	if err := h.Validate(); err != nil {
+		return Webhook{}, Error{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		}
+	}
+	id, err := RandomUuid()
+	if err != nil {
+		return Webhook{}, err
+	}
+	h.ID = id
+	h.CreatedAt = time.Now().UTC()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	hooks := w.copyHooks()
+	hooks[id] = h
+	if err := w.save(hooks); err != nil {
+		return Webhook{}, err
+	}
+	return h, nil
+}
+
+func (w *Webhooks) Update(id string, fn func(h *Webhook) error) (Webhook, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	h, ok := w.hooks[id]
+	if !ok {
+		return Webhook{}, ErrWebhookNotFound
+	}
+	if err := fn(&h); err != nil {
+		return Webhook{}, err
+	}
+	if err := h.Validate(); err != nil {
+		return Webhook{}, Error{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		}
+	}
+	hooks := w.copyHooks()
+	hooks[id] = h
+	if err := w.save(hooks); err != nil {
+		return Webhook{}, err
+	}
+	return h, nil
+}
+
+func (w *Webhooks) Delete(id string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.hooks[id]; !ok {
+		return ErrWebhookNotFound
+	}
+	hooks := w.copyHooks()
+	delete(hooks, id)
+	if err := w.save(hooks); err != nil {
+		return err
+	}
+	delete(w.deliveries, id)
+	return nil
+}
+
+func (w *Webhooks) copyHooks() map[string]Webhook {
+	hooks := make(map[string]Webhook, len(w.hooks))
+	for id, h := range w.hooks {
+		hooks[id] = h
+	}
+	return hooks
+}
+
+// save writes the webhooks and swaps them in only once they are stored,
+// so a failed write changes nothing. Callers hold mu.
+func (w *Webhooks) save(hooks map[string]Webhook) error {
+	if err := w.c.Save("webhooks", hooks); err != nil {
+		return err
+	}
+	w.hooks = hooks
+	return nil
+}
+
+func (w *Webhooks) Deliveries(id string) ([]Delivery, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if _, ok := w.hooks[id]; !ok {
+		return nil, ErrWebhookNotFound
+	}
+	deliveries := make([]Delivery, len(w.deliveries[id]))
+	copy(deliveries, w.deliveries[id])
+	return deliveries, nil
+}
+
+func (w *Webhooks) record(hookID string, d Delivery) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.hooks[hookID]; !ok {
+		return
+	}
+	deliveries := append(w.deliveries[hookID], d)
+	if len(deliveries) > webhookDeliveriesSize {
+		deliveries = deliveries[len(deliveries)-webhookDeliveriesSize:]
+	}
+	w.deliveries[hookID] = deliveries
+}
+
+// Run delivers the events until ctx is done. Then it waits for the
+// requests in flight, pending retries are dropped. When it falls behind
+// and the broker drops it, the missed events are replayed from the ring.
+func (w *Webhooks) Run(ctx context.Context, events *Broker) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ch, _ := events.Subscribe(0)
+	defer func() { events.Unsubscribe(ch) }()
+	var lastID uint64
+	handle := func(e Event) {
+		lastID = e.ID
+		for _, h := range w.List() {
+			if h.Matches(e) {
+				wg.Add(1)
+				go func(id string) {
+					defer wg.Done()
+					w.deliver(ctx, id, e)
+				}(h.ID)
+			}
+		}
+	}
+	for {
+		var e Event
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok = <-ch:
+		}
+		if ok {
+			handle(e)
+			continue
+		}
+		var backlog []Event
+		ch, backlog = events.Subscribe(lastID)
+		if len(backlog) > 0 && lastID > 0 && backlog[0].ID > lastID+1 {
+			logrus.Warnf("Webhooks fell behind the events, %d deliveries are lost", backlog[0].ID-lastID-1)
+		}
+		for _, e := range backlog {
+			handle(e)
+		}
+	}
+}
+
+func (w *Webhooks) deliver(ctx context.Context, hookID string, e Event) {
+	id, err := RandomUuid()
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	body, err := json.Marshal(WebhookPayload{
+		Delivery:      id,
+		Event:         e.Type,
+		JobID:         e.JobID,
+		PreviousState: e.PreviousState,
+		CreatedAt:     e.CreatedAt,
+		Data:          e.Data,
+	})
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		// The hook may be changed or deleted between the attempts.
+		h, err := w.Get(hookID)
+		if err != nil {
+			return
+		}
+		d := Delivery{
+			ID:          id,
+			EventID:     e.ID,
+			Event:       e.Type,
+			Attempt:     attempt,
+			DeliveredAt: time.Now().UTC(),
+		}
+		d.StatusCode, err = w.post(h, id, e.Type, body)
+		if err == nil && (d.StatusCode < 200 || d.StatusCode > 299) {
+			err = fmt.Errorf("Unexpected status code %d", d.StatusCode)
+		}
+		d.Success = err == nil
+		var delay time.Duration
+		if err != nil {
+			d.Error = err.Error()
+			if attempt < w.policy.MaxAttempts {
+				delay = w.policy.Next(attempt)
+				d.NextRetryAt = time.Now().UTC().Add(delay)
+			}
+			logrus.Errorf("Webhook '%s' delivery '%s' attempt %d failed: %v", hookID, id, attempt, err)
+		}
+		w.record(hookID, d)
+		if d.Success || d.NextRetryAt.IsZero() {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			logrus.Warnf("Webhook '%s' delivery '%s' is dropped on shutdown", hookID, id)
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (w *Webhooks) post(h Webhook, deliveryID, event string, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", fmt.Sprintf("%s/%s", BaseName, Version))
+	req.Header.Set(WebhookEventHeader, event)
+	req.Header.Set(WebhookDeliveryHeader, deliveryID)
+	if h.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, Sign(h.Secret, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func (s *Server) WebhookErrorHandler(w http.ResponseWriter, id string, err error) {
+	encoder := json.NewEncoder(w)
+	switch e := err.(type) {
+	case Error:
+		logrus.Errorf("Webhook '%s': %s", id, e.Message)
+		w.WriteHeader(e.Code)
+		encoder.Encode(e)
+	default:
+		if err == ErrWebhookNotFound {
+			logrus.Errorf("Webhook '%s' not found", id)
+			w.WriteHeader(http.StatusNotFound)
+			encoder.Encode(Error{
+				Code:    http.StatusNotFound,
+				Message: "Webhook not found",
+			})
+			return
+		}
+		logrus.Errorf("Webhook '%s' store error: %v", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(Error{
+			Code:    http.StatusInternalServerError,
+			Message: fmt.Sprintf("Store error: %v", err),
+		})
+	}
+}
+
+func (s *Server) WebhookListHandler(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug("Got webhook-list request")
+	encoder := json.NewEncoder(w)
+	list := []Webhook{}
+	for _, h := range s.webhooks.List() {
+		list = append(list, h.Public())
+	}
+	encoder.Encode(list)
+}
+
+func (s *Server) WebhookNewHandler(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug("Got webhook-new request")
+	decoder := json.NewDecoder(r.Body)
+	encoder := json.NewEncoder(w)
+	var h Webhook
+	if err := decoder.Decode(&h); err != nil {
+		logrus.Error(err)
+		w.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(Error{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("Error with decoding request body: %v", err),
+		})
+		return
+	}
+	h, err := s.webhooks.Add(h)
+	if err != nil {
+		s.WebhookErrorHandler(w, "", err)
+		return
+	}
+	logrus.Infof("Webhook '%s' created for %s", h.ID, h.URL)
+	w.WriteHeader(http.StatusCreated)
+	encoder.Encode(h.Public())
+}
+
+func (s *Server) WebhookInfoHandler(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug("Got webhook-info request")
+	vars := mux.Vars(r)
+	encoder := json.NewEncoder(w)
+	h, err := s.webhooks.Get(vars["id"])
+	if err != nil {
+		s.WebhookErrorHandler(w, vars["id"], err)
+		return
+	}
+	encoder.Encode(h.Public())
+}
+
+func (s *Server) WebhookUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug("Got webhook-update request")
+	vars := mux.Vars(r)
+	decoder := json.NewDecoder(r.Body)
+	encoder := json.NewEncoder(w)
+	var req struct {
+		URL    string         `json:"url"`
+		Events []string       `json:"events"`
+		States []peskar.State `json:"states"`
+		Secret *string        `json:"secret"`
+	}
+	if err := decoder.Decode(&req); err != nil {
+		logrus.Error(err)
+		w.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(Error{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("Error with decoding request body: %v", err),
+		})
+		return
+	}
+	h, err := s.webhooks.Update(vars["id"], func(h *Webhook) error {
+		if req.URL != "" {
+			h.URL = req.URL
+		}
+		if req.Events != nil {
+			h.Events = req.Events
+		}
+		if req.States != nil {
+			h.States = req.States
+		}
+		if req.Secret != nil {
+			h.Secret = *req.Secret
+		}
+		return nil
+	})
+	if err != nil {
+		s.WebhookErrorHandler(w, vars["id"], err)
+		return
+	}
+	logrus.Infof("Webhook '%s' updated", h.ID)
+	encoder.Encode(h.Public())
+}
+
+func (s *Server) WebhookDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug("Got webhook-delete request")
+	vars := mux.Vars(r)
+	if err := s.webhooks.Delete(vars["id"]); err != nil {
+		s.WebhookErrorHandler(w, vars["id"], err)
+		return
+	}
+	logrus.Infof("Webhook '%s' deleted", vars["id"])
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) WebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug("Got webhook-deliveries request")
+	vars := mux.Vars(r)
+	encoder := json.NewEncoder(w)
+	deliveries, err := s.webhooks.Deliveries(vars["id"])
+	if err != nil {
+		s.WebhookErrorHandler(w, vars["id"], err)
+		return
+	}
+	encoder.Encode(deliveries)
+}
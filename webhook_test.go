@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/paradev-ru/peskar-hub/peskar"
+)
+
+// TestWebhooksSaveError checks that changes that could not be saved are
+// not applied.
+func TestWebhooksSaveError(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	w := NewWebhooks(NewBackend(dir, 0), peskar.RetryPolicy{}, time.Second)
+	h, err := w.Add(Webhook{URL: "http://example.com/hook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Add(Webhook{URL: "http://example.com/other"}); err == nil {
+		t.Error("Add succeeded without a data directory")
+	}
+	if _, err := w.Update(h.ID, func(h *Webhook) error {
+		h.URL = "http://example.com/changed"
+		return nil
+	}); err == nil {
+		t.Error("Update succeeded without a data directory")
+	}
+	if err := w.Delete(h.ID); err == nil {
+		t.Error("Delete succeeded without a data directory")
+	}
+
+	list := w.List()
+	if len(list) != 1 || list[0].URL != h.URL {
+		t.Errorf("webhooks changed by failed saves: %+v", list)
+	}
+}
+
+func testWebhooks(t *testing.T, policy peskar.RetryPolicy) *Webhooks {
+	return NewWebhooks(NewBackend(t.TempDir(), 0), policy, time.Second)
+}
+
+func TestSign(t *testing.T) {
+	got := Sign("secret", []byte(`{"event":"job.created"}`))
+	want := "sha256=da6e7b0fc081b9fd7130eef3eefac90edd58c2247457c937dfa5403e6a799c0b"
+	if got != want {
+		t.Errorf("Sign = %s, want %s", got, want)
+	}
+}
+
+func TestWebhookMatches(t *testing.T) {
+	finished := peskar.Job{ID: "a", State: peskar.StateFinished}
+	tests := []struct {
+		name  string
+		hook  Webhook
+		event Event
+		want  bool
+	}{
+		{"everything", Webhook{}, Event{Type: EventJobLog}, true},
+		{"event listed", Webhook{Events: []string{EventJobCreated, EventJobLog}}, Event{Type: EventJobLog}, true},
+		{"event not listed", Webhook{Events: []string{EventJobCreated}}, Event{Type: EventJobLog}, false},
+		{"state reached", Webhook{States: []peskar.State{peskar.StateFinished}}, Event{Type: EventJobUpdated, Data: finished, PreviousState: peskar.StateWorking}, true},
+		{"state kept", Webhook{States: []peskar.State{peskar.StateFinished}}, Event{Type: EventJobUpdated, Data: finished, PreviousState: peskar.StateFinished}, false},
+		{"other state", Webhook{States: []peskar.State{peskar.StateFailed}}, Event{Type: EventJobUpdated, Data: finished, PreviousState: peskar.StateWorking}, false},
+		{"states skip other events", Webhook{States: []peskar.State{peskar.StateFinished}}, Event{Type: EventWorkerState, Data: peskar.Worker{}}, false},
+		{"deleted job", Webhook{Events: []string{EventJobDeleted}, States: []peskar.State{peskar.StateFinished}}, Event{Type: EventJobDeleted, Data: finished, PreviousState: peskar.StateFinished}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.hook.Matches(tt.event); got != tt.want {
+			t.Errorf("%s: Matches = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	var mu sync.Mutex
+	var requests []*http.Request
+	var bodies [][]byte
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r)
+		bodies = append(bodies, body)
+		if len(requests) < 3 {
+			rw.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer ts.Close()
+
+	delay := 10 * time.Millisecond
+	w := testWebhooks(t, peskar.RetryPolicy{MaxAttempts: 3, Backoff: peskar.BackoffExponential, Delay: delay})
+	h, err := w.Add(Webhook{URL: ts.URL, Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.deliver(context.Background(), h.ID, Event{ID: 7, Type: EventJobCreated, JobID: "a", Data: peskar.Job{ID: "a"}})
+
+	deliveries, err := w.Deliveries(h.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 3 {
+		t.Fatalf("got %d deliveries, want 3", len(deliveries))
+	}
+	for i, d := range deliveries {
+		if d.Attempt != i+1 || d.EventID != 7 || d.ID != deliveries[0].ID {
+			t.Errorf("delivery %d: %+v", i, d)
+		}
+		if i < 2 {
+			wait := d.NextRetryAt.Sub(d.DeliveredAt)
+			if d.Success || d.StatusCode != http.StatusBadGateway || wait < delay<<uint(i) || wait > delay<<uint(i)+time.Second {
+				t.Errorf("failed delivery %d: %+v, retry in %v", i, d, wait)
+			}
+		} else if !d.Success || !d.NextRetryAt.IsZero() || d.Error != "" {
+			t.Errorf("last delivery: %+v", d)
+		}
+	}
+	for i, r := range requests {
+		if r.Header.Get(WebhookSignatureHeader) != Sign("secret", bodies[i]) ||
+			r.Header.Get(WebhookEventHeader) != EventJobCreated ||
+			r.Header.Get(WebhookDeliveryHeader) != deliveries[0].ID {
+			t.Errorf("request %d headers: %v", i, r.Header)
+		}
+	}
+	var payload WebhookPayload
+	if err := json.Unmarshal(bodies[0], &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != EventJobCreated || payload.JobID != "a" || payload.Delivery != deliveries[0].ID {
+		t.Errorf("payload: %+v", payload)
+	}
+}
+
+func TestWebhookDeliveryGivesUp(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	w := testWebhooks(t, peskar.RetryPolicy{MaxAttempts: 2, Backoff: peskar.BackoffFixed, Delay: time.Millisecond})
+	h, err := w.Add(Webhook{URL: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.deliver(context.Background(), h.ID, Event{ID: 1, Type: EventJobLog})
+	deliveries, _ := w.Deliveries(h.ID)
+	if len(deliveries) != 2 || deliveries[1].Success || !deliveries[1].NextRetryAt.IsZero() {
+		t.Errorf("deliveries: %+v", deliveries)
+	}
+}
+
+func TestWebhookDeliveriesCap(t *testing.T) {
+	w := testWebhooks(t, peskar.RetryPolicy{MaxAttempts: 1})
+	h, err := w.Add(Webhook{URL: "http://example.com/hook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= webhookDeliveriesSize+10; i++ {
+		w.record(h.ID, Delivery{EventID: uint64(i)})
+	}
+	w.record("unknown", Delivery{EventID: 1})
+	deliveries, _ := w.Deliveries(h.ID)
+	if len(deliveries) != webhookDeliveriesSize || deliveries[0].EventID != 11 || deliveries[len(deliveries)-1].EventID != webhookDeliveriesSize+10 {
+		t.Errorf("got %d deliveries from %d", len(deliveries), deliveries[0].EventID)
+	}
+	if _, err := w.Deliveries("unknown"); err != ErrWebhookNotFound {
+		t.Errorf("deliveries of an unknown webhook: %v", err)
+	}
+}
+
+// TestWebhooksFallBehind checks that events published while the
+// webhooks are busy are replayed after the broker drops them.
+func TestWebhooksFallBehind(t *testing.T) {
+	const events = 3 * eventsChanSize
+	var mu sync.Mutex
+	received := make(map[string]bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var payload WebhookPayload
+		json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		defer mu.Unlock()
+		received[payload.JobID] = true
+	}))
+	defer ts.Close()
+
+	w := testWebhooks(t, peskar.RetryPolicy{MaxAttempts: 1})
+	if _, err := w.Add(Webhook{URL: ts.URL}); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBroker(DefaultEventsSize)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Run(ctx, b)
+	}()
+	// Wait for Run to subscribe.
+	for {
+		b.mu.Lock()
+		n := len(b.subs)
+		b.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Run blocks on the webhooks list while the events pile up.
+	w.mu.Lock()
+	for i := 0; i < events; i++ {
+		b.Publish(EventJobLog, fmt.Sprint(i), i)
+	}
+	w.mu.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(received)
+		mu.Unlock()
+		if n == events || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != events {
+		t.Errorf("delivered %d events, want %d", len(received), events)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+	"github.com/paradev-ru/peskar-hub/peskar"
+)
+
+const (
+	SocketMessageReady    = "ready"
+	SocketMessageJob      = "job"
+	SocketMessageLog      = "log"
+	SocketMessageProgress = "progress"
+	SocketMessageState    = "state"
+	SocketMessageLease    = "lease"
+	SocketMessageError    = "error"
+
+	socketWriteTimeout     = 10 * time.Second
+	socketPingInterval     = 30 * time.Second
+	socketDispatchInterval = 30 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	// Workers are not browsers, there is no page to protect.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// SocketMessage is sent both ways over the worker socket. The hub sends
+// job and error messages, the worker sends the rest.
+type SocketMessage struct {
+	Type     string           `json:"type"`
+	JobID    string           `json:"job_id,omitempty"`
+	Job      *peskar.Job      `json:"job,omitempty"`
+	Log      *peskar.LogItem  `json:"log,omitempty"`
+	Progress *peskar.Progress `json:"progress,omitempty"`
+	State    peskar.State     `json:"state,omitempty"`
+	Error    *Error           `json:"error,omitempty"`
+}
+
+// Sockets counts open sockets per worker, so that the worker goes
+// inactive only when its last socket is closed.
+type Sockets struct {
+	mu    sync.Mutex
+	count map[string]int
+	wg    sync.WaitGroup
+}
+
+func NewSockets() *Sockets {
+	return &Sockets{count: make(map[string]int)}
+}
+
+func (c *Sockets) Open(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.count[id]++
+	c.wg.Add(1)
+}
+
+func (c *Sockets) Close(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.count[id]--
+	if c.count[id] > 0 {
+		return false
+	}
+	delete(c.count, id)
+	return true
+}
+
+// Done marks the end of a socket handler opened with Open.
+func (c *Sockets) Done() {
+	c.wg.Done()
+}
+
+// Go runs fn along with a socket handler, Wait waits for it as well.
+func (c *Sockets) Go(fn func()) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		fn()
+	}()
+}
+
+// Wait blocks until all socket handlers are done. Hijacked connections
+// are not tracked by the HTTP server shutdown.
+func (c *Sockets) Wait() {
+	c.wg.Wait()
+}
+
+type workerSocket struct {
+	s      *Server
+	conn   *websocket.Conn
+	id     string
+	out    chan SocketMessage
+	ready  chan struct{}
+	closed chan struct{}
+	done   chan struct{}
+}
+
+func (s *Server) WorkerSocketHandler(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug("Got worker-socket request")
+	worker, err := s.UpdateWorkerInfo(r)
+	if err != nil {
+		logrus.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	s.sockets.Open(worker.ID)
+	defer s.sockets.Done()
+	logrus.Infof("Worker '%s' connected from %s", worker.ID, worker.IP)
+	ws := &workerSocket{
+		s:      s,
+		conn:   conn,
+		id:     worker.ID,
+		out:    make(chan SocketMessage, 16),
+		ready:  make(chan struct{}, 1),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	s.sockets.Go(ws.read)
+	ws.write()
+	conn.Close()
+	logrus.Infof("Worker '%s' disconnected", worker.ID)
+	if s.sockets.Close(worker.ID) {
+		s.WorkerDisconnected(worker.ID)
+	}
+}
+
+func (s *Server) WorkerDisconnected(id string) {
+	worker, err := s.w.Update(id, func(worker *peskar.Worker) error {
+		worker.State = "inactive"
+		return nil
+	})
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	s.events.Publish(EventWorkerState, "", worker)
+}
+
+func (ws *workerSocket) read() {
+	defer close(ws.closed)
+	pongWait := 2 * socketPingInterval
+	ws.conn.SetReadDeadline(time.Now().Add(pongWait))
+	ws.conn.SetPongHandler(func(string) error {
+		return ws.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		var msg SocketMessage
+		if err := ws.conn.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logrus.Errorf("Worker '%s' socket error: %v", ws.id, err)
+			}
+			return
+		}
+		ws.conn.SetReadDeadline(time.Now().Add(pongWait))
+		if msg.Type == SocketMessageReady {
+			select {
+			case ws.ready <- struct{}{}:
+			default:
+			}
+			continue
+		}
+		if err := ws.handle(msg); err != nil {
+			ws.send(SocketMessage{
+				Type:  SocketMessageError,
+				JobID: msg.JobID,
+				Error: socketError(err),
+			})
+		}
+	}
+}
+
+func (ws *workerSocket) handle(msg SocketMessage) error {
+	var err error
+	switch msg.Type {
+	case SocketMessageLog:
+		if msg.Log == nil || msg.Log.Message == "" {
+			return Error{
+				Code:    http.StatusBadRequest,
+				Message: "Empty log message",
+			}
+		}
+		log := *msg.Log
+		log.Initiator = "worker"
+		_, err = ws.s.AddLog(msg.JobID, ws.id, log)
+	case SocketMessageProgress:
+		if msg.Progress == nil {
+			return Error{
+				Code:    http.StatusBadRequest,
+				Message: "Empty progress",
+			}
+		}
+		_, err = ws.s.UpdateProgress(msg.JobID, ws.id, *msg.Progress)
+	case SocketMessageState:
+		_, err = ws.s.UpdateState(msg.JobID, ws.id, msg.State)
+	case SocketMessageLease:
+		_, err = ws.s.RenewLease(msg.JobID, ws.id)
+	default:
+		return Error{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("Unknown message type '%s'", msg.Type),
+		}
+	}
+	return err
+}
+
+func socketError(err error) *Error {
+	switch e := err.(type) {
+	case Error:
+		return &e
+	}
+	if err == ErrJobNotFound {
+		return &Error{
+			Code:    http.StatusNotFound,
+			Message: "Job not found",
+		}
+	}
+	return &Error{
+		Code:    http.StatusInternalServerError,
+		Message: fmt.Sprintf("Store error: %v", err),
+	}
+}
+
+func (ws *workerSocket) send(msg SocketMessage) {
+	select {
+	case ws.out <- msg:
+	case <-ws.done:
+	}
+}
+
+// write owns the connection writes. A worker that sent ready is offered
+// a job whenever the queue changes and periodically, for jobs waiting
+// for a retry or the end of the dnd mode.
+func (ws *workerSocket) write() {
+	defer close(ws.done)
+	events, _ := ws.s.events.Subscribe(0)
+	defer func() { ws.s.events.Unsubscribe(events) }()
+	ping := time.NewTicker(socketPingInterval)
+	defer ping.Stop()
+	dispatch := time.NewTicker(socketDispatchInterval)
+	defer dispatch.Stop()
+	var waiting bool
+	for {
+		select {
+		case <-ws.closed:
+			return
+		case <-ws.s.streams.Done():
+			ws.conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+			ws.conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "Hub is shutting down"))
+			return
+		case msg := <-ws.out:
+			if err := ws.writeJSON(msg); err != nil {
+				return
+			}
+			continue
+		case <-ws.ready:
+			waiting = true
+		case e, ok := <-events:
+			if !ok {
+				events, _ = ws.s.events.Subscribe(0)
+			}
+			if !ok || e.JobID == "" {
+				continue
+			}
+		case <-dispatch.C:
+		case <-ping.C:
+			ws.conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+			if err := ws.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+			ws.touch()
+			continue
+		}
+		if !waiting {
+			continue
+		}
+		job, err := ws.offer()
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+		if job == nil {
+			continue
+		}
+		waiting = false
+		if err := ws.writeJSON(SocketMessage{
+			Type:  SocketMessageJob,
+			JobID: job.ID,
+			Job:   job,
+		}); err != nil {
+			// The worker never got the job, do not wait for the
+			// request timeout to give it to another one.
+			if err := ws.s.ReleaseJob(job.ID, ws.id); err != nil {
+				logrus.Error(err)
+			}
+			return
+		}
+	}
+}
+
+func (ws *workerSocket) offer() (*peskar.Job, error) {
+	worker, err := ws.s.w.Get(ws.id)
+	if err != nil {
+		return nil, err
+	}
+	job, err := ws.s.Dispatch(worker)
+	if _, ok := err.(Error); ok {
+		return nil, nil
+	}
+	return job, err
+}
+
+func (ws *workerSocket) touch() {
+	var stateChanged bool
+	worker, err := ws.s.w.Update(ws.id, func(worker *peskar.Worker) error {
+		stateChanged = worker.State != "active"
+		worker.State = "active"
+		worker.LastSeenAt = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	if stateChanged {
+		ws.s.events.Publish(EventWorkerState, "", worker)
+	}
+}
+
+func (ws *workerSocket) writeJSON(msg SocketMessage) error {
+	ws.conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+	if err := ws.conn.WriteJSON(msg); err != nil {
+		logrus.Errorf("Worker '%s' socket error: %v", ws.id, err)
+		return err
+	}
+	return nil
+}
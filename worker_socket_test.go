@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/paradev-ru/peskar-hub/peskar"
+)
+
+func dialWorker(t *testing.T, ts *httptest.Server, id string) *websocket.Conn {
+	header := http.Header{}
+	header.Set(peskar.WorkerIDHeader, id)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/v1/ws/", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readMessage(t *testing.T, conn *websocket.Conn) SocketMessage {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg SocketMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func writeMessage(t *testing.T, conn *websocket.Conn, msg SocketMessage) {
+	if err := conn.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// syncSocket waits until the hub has handled the messages sent before: they
+// are handled in order and an unknown one is answered with an error.
+func syncSocket(t *testing.T, conn *websocket.Conn) {
+	writeMessage(t, conn, SocketMessage{Type: "sync"})
+	for {
+		msg := readMessage(t, conn)
+		if msg.Type == SocketMessageError && strings.Contains(msg.Error.Message, "'sync'") {
+			return
+		}
+		t.Errorf("unexpected message %+v", msg)
+	}
+}
+
+func TestWorkerSocket(t *testing.T) {
+	s := testServer(t, 1)
+	s.config.LeaseDuration = time.Hour
+	ids := addTestJobs(t, s, 1)
+	ts := httptest.NewServer(s.r)
+	defer ts.Close()
+	conn := dialWorker(t, ts, "worker")
+
+	writeMessage(t, conn, SocketMessage{Type: SocketMessageReady})
+	msg := readMessage(t, conn)
+	if msg.Type != SocketMessageJob || msg.JobID != ids[0] || msg.Job == nil ||
+		msg.Job.State != peskar.StateRequested || msg.Job.WorkerID != "worker" {
+		t.Fatalf("got %+v, want job '%s'", msg, ids[0])
+	}
+
+	writeMessage(t, conn, SocketMessage{Type: SocketMessageState, JobID: ids[0], State: peskar.StateWorking})
+	writeMessage(t, conn, SocketMessage{Type: SocketMessageLog, JobID: ids[0], Log: &peskar.LogItem{Message: "Downloading"}})
+	writeMessage(t, conn, SocketMessage{Type: SocketMessageProgress, JobID: ids[0], Progress: &peskar.Progress{BytesDone: 5, BytesTotal: 10}})
+	writeMessage(t, conn, SocketMessage{Type: SocketMessageLease, JobID: ids[0]})
+	syncSocket(t, conn)
+
+	job, err := s.j.Get(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := job.LogList()
+	if job.State != peskar.StateWorking || job.Progress == nil || job.Progress.BytesDone != 5 ||
+		job.LeaseExpiresAt.Before(time.Now().Add(30*time.Minute)) {
+		t.Errorf("job after worker messages: %+v", job)
+	}
+	if len(logs) != 1 || logs[0].Message != "Downloading" || logs[0].Initiator != "worker" {
+		t.Errorf("job log: %+v", logs)
+	}
+}
+
+func TestWorkerSocketErrors(t *testing.T) {
+	s := testServer(t, 1)
+	ids := addTestJobs(t, s, 1)
+	if job, err := s.Dispatch(peskar.Worker{ID: "other"}); err != nil || job == nil {
+		t.Fatal(job, err)
+	}
+	ts := httptest.NewServer(s.r)
+	defer ts.Close()
+	conn := dialWorker(t, ts, "worker")
+
+	tests := []struct {
+		name string
+		msg  SocketMessage
+		code int
+	}{
+		{"unknown type", SocketMessage{Type: "hello"}, http.StatusBadRequest},
+		{"empty log", SocketMessage{Type: SocketMessageLog, JobID: ids[0], Log: &peskar.LogItem{}}, http.StatusBadRequest},
+		{"empty progress", SocketMessage{Type: SocketMessageProgress, JobID: ids[0]}, http.StatusBadRequest},
+		{"unknown job", SocketMessage{Type: SocketMessageLease, JobID: "unknown"}, http.StatusNotFound},
+		{"job of another worker", SocketMessage{Type: SocketMessageState, JobID: ids[0], State: peskar.StateWorking}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		writeMessage(t, conn, tt.msg)
+		msg := readMessage(t, conn)
+		if msg.Type != SocketMessageError || msg.Error == nil || msg.Error.Code != tt.code || msg.JobID != tt.msg.JobID {
+			t.Errorf("%s: got %+v, want error %d", tt.name, msg, tt.code)
+		}
+	}
+}
+
+func TestWorkerSocketClose(t *testing.T) {
+	s := testServer(t, 1)
+	ts := httptest.NewServer(s.r)
+	defer ts.Close()
+	events, _ := s.events.Subscribe(0)
+	defer s.events.Unsubscribe(events)
+
+	first := dialWorker(t, ts, "worker")
+	second := dialWorker(t, ts, "worker")
+	if worker, err := s.w.Get("worker"); err != nil || worker.State != "active" {
+		t.Fatal(worker, err)
+	}
+	first.Close()
+	syncSocket(t, second)
+	if worker, _ := s.w.Get("worker"); worker.State != "active" {
+		t.Errorf("worker is '%s' with a socket open", worker.State)
+	}
+	second.Close()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if worker, ok := e.Data.(peskar.Worker); ok && e.Type == EventWorkerState && worker.State == "inactive" {
+				if worker, _ := s.w.Get("worker"); worker.State != "inactive" {
+					t.Errorf("worker is '%s'", worker.State)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("worker did not go inactive")
+		}
+	}
+}
+
+func TestWorkerSocketTouch(t *testing.T) {
+	s := testServer(t, 1)
+	if _, err := s.w.Upsert("worker", func(worker *peskar.Worker) error {
+		worker.ID = "worker"
+		worker.State = "inactive"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	events, _ := s.events.Subscribe(0)
+	defer s.events.Unsubscribe(events)
+	ws := &workerSocket{s: s, id: "worker"}
+	ws.touch()
+	ws.touch()
+	select {
+	case e := <-events:
+		if worker, ok := e.Data.(peskar.Worker); !ok || e.Type != EventWorkerState || worker.State != "active" {
+			t.Errorf("got %+v", e)
+		}
+	default:
+		t.Fatal("touch did not publish the worker state")
+	}
+	select {
+	case e := <-events:
+		t.Errorf("touch of an active worker published %+v", e)
+	default:
+	}
+}
+
+func TestReleaseJob(t *testing.T) {
+	s := testServer(t, 1)
+	ids := addTestJobs(t, s, 1)
+	if job, err := s.Dispatch(peskar.Worker{ID: "worker"}); err != nil || job == nil {
+		t.Fatal(job, err)
+	}
+	if err := s.ReleaseJob(ids[0], "other"); err == nil {
+		t.Error("job released by another worker")
+	}
+	if err := s.ReleaseJob(ids[0], "worker"); err != nil {
+		t.Fatal(err)
+	}
+	job, err := s.j.Get(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != peskar.StatePending || job.WorkerID != "" {
+		t.Errorf("released job: %+v", job)
+	}
+	if job, err := s.Dispatch(peskar.Worker{ID: "other"}); err != nil || job == nil || job.ID != ids[0] {
+		t.Errorf("released job not dispatched again: %v, %v", job, err)
+	}
+}